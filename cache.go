@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Upper bound on cached /data variants; the cache is cleared when it fills up
+const maxCacheEntries = 1000
+
+// How often the change listener pings its connection, so a connection that
+// dropped silently is noticed and re-established
+const listenerPingInterval = 90 * time.Second
+
+// Response headers describing the body, saved alongside it in the cache.
+// Others, like CORS headers, depend on the request and are set per response.
+var cachedHeaders = []string{"Content-Type", "ETag", "X-Total-Count", "X-Result-Truncated", "Last-Modified"}
+
+// In-memory cache of serialized /data responses. It is disabled while ttl is
+// zero, and any write request invalidates it.
+type responseCache struct {
+	mu         sync.RWMutex
+	ttl        time.Duration
+	generation uint64 // Bumped on invalidation so in-flight renders are not stored
+	entries    map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// Create a response cache holding entries for ttl; zero disables it
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{ttl: ttl, entries: make(map[string]cachedResponse)}
+}
+
+// Drop all cached responses
+func (c *responseCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	clear(c.entries)
+}
+
+// Return the cached response for key if it has not expired
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return cachedResponse{}, false
+	}
+	return entry, true
+}
+
+// Store a response rendered while the cache was at the given generation
+func (c *responseCache) put(key string, generation uint64, entry cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= maxCacheEntries {
+		clear(c.entries)
+	}
+	entry.expires = time.Now().Add(c.ttl)
+	c.entries[key] = entry
+}
+
+// Tee a response into a buffer so it can be cached once it completes
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (rc *responseCapture) WriteHeader(status int) {
+	if rc.status == 0 {
+		rc.status = status
+	}
+	rc.ResponseWriter.WriteHeader(status)
+}
+
+func (rc *responseCapture) Write(b []byte) (int, error) {
+	if rc.status == 0 {
+		rc.status = http.StatusOK
+	}
+	rc.buf.Write(b)
+	return rc.ResponseWriter.Write(b)
+}
+
+func (rc *responseCapture) Unwrap() http.ResponseWriter {
+	return rc.ResponseWriter
+}
+
+// Serve GET responses from the cache when it is enabled, keyed by the
+// normalized query string and negotiated format. Successful responses are
+// captured and stored for the configured TTL.
+func (c *responseCache) cacheResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.ttl <= 0 || r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+
+		key := fmt.Sprintf("csv=%t?%s", prefersCSV(r), r.URL.Query().Encode())
+		if entry, ok := c.get(key); ok {
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			if isNotModified(r, entry.header.Get("ETag"), entry.header.Get("Last-Modified")) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write(entry.body)
+			return
+		}
+
+		c.mu.RLock()
+		generation := c.generation
+		c.mu.RUnlock()
+
+		capture := &responseCapture{ResponseWriter: w}
+		next(capture, r)
+		if capture.status == http.StatusOK {
+			header := make(http.Header)
+			for _, name := range cachedHeaders {
+				if value := w.Header().Get(name); value != "" {
+					header.Set(name, value)
+				}
+			}
+			c.put(key, generation, cachedResponse{header: header, body: capture.buf.Bytes()})
+		}
+	}
+}
+
+// Invalidate the cache after every request that may have written data
+func (c *responseCache) invalidateCacheOnWrite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			c.invalidate()
+		}
+	})
+}
+
+// Invalidate the cache whenever the table changes, including changes made by
+// other instances or by hand, until ctx is done. The trigger installed with
+// CACHE_NOTIFY announces every write statement on the table's channel. The
+// cache is also cleared after a reconnect, since notifications sent while the
+// connection was down are lost.
+func (c *responseCache) listenForChanges(ctx context.Context, connStr, channel string) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			logWarnf("Cache invalidation listener lost its database connection: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Println("Cache invalidation listener reconnected.")
+		}
+	})
+	defer listener.Close()
+	context.AfterFunc(ctx, func() { listener.Close() }) // Also ends a Listen waiting to connect
+
+	if err := listener.Listen(channel); err != nil {
+		if ctx.Err() == nil {
+			logErrorf("Unable to listen on %s: %v. Changes from other instances won't invalidate the cache.", channel, err)
+		}
+		return
+	}
+	logEvent("cache_notify_listening", "Listening for table changes to invalidate the cache.", "channel", channel)
+
+	ticker := time.NewTicker(listenerPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-listener.Notify: // nil after a reconnect, which invalidates as well
+			c.invalidate()
+		case <-ticker.C:
+			go listener.Ping()
+		}
+	}
+}
+
+// Compute a weak ETag for a /data response from the state of the matching rows
+// (count, highest id, latest change) and everything in the request that
+// shapes the body. Inserts, deletes, and updates all change at least one of
+// the row values, so the tag changes whenever the response would.
+func (s *Server) dataETag(r *http.Request, count, maxID int64, lastChange *time.Time, format string) string {
+	var changed int64
+	if lastChange != nil {
+		changed = lastChange.UnixMicro()
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%d|%d|%s|%s|%s", count, maxID, changed, r.URL.RawQuery, format, s.ipfsGateway)
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// Report whether an If-None-Match header matches etag, using the weak
+// comparison required for GET and HEAD requests
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether the client's copy is current: its If-None-Match matches the
+// ETag or, when it sent none, nothing changed after If-Modified-Since. The
+// ETag takes precedence because it also reflects deletions, which leave the
+// latest modification time untouched.
+func isNotModified(r *http.Request, etag, lastModified string) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified == "" {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	return err == nil && !modified.After(since)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	base58Alphabet      = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	base32LowerAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+	cidV0Length    = 46
+	cidV1MinLength = 10
+)
+
+// Check that cid has the basic shape of an IPFS content identifier: either a
+// CIDv0 ("Qm" followed by base58btc, 46 characters) or a CIDv1 in base32
+// ("b" prefix) or base58btc ("z" prefix) multibase encoding. The multihash
+// itself is not decoded.
+func validateCID(cid string) error {
+	switch {
+	case strings.HasPrefix(cid, "Qm"):
+		if len(cid) != cidV0Length {
+			return fmt.Errorf("invalid CIDv0 %q: expected %d characters, got %d", cid, cidV0Length, len(cid))
+		}
+		return checkAlphabet(cid, 0, base58Alphabet)
+	case strings.HasPrefix(cid, "b"):
+		if len(cid) < cidV1MinLength {
+			return fmt.Errorf("invalid CIDv1 %q: too short", cid)
+		}
+		return checkAlphabet(cid, 1, base32LowerAlphabet)
+	case strings.HasPrefix(cid, "z"):
+		if len(cid) < cidV1MinLength {
+			return fmt.Errorf("invalid CIDv1 %q: too short", cid)
+		}
+		return checkAlphabet(cid, 1, base58Alphabet)
+	default:
+		return fmt.Errorf("invalid CID %q: expected a Qm..., b... or z... identifier", cid)
+	}
+}
+
+// Ensure every character of cid after the multibase prefix belongs to the given alphabet
+func checkAlphabet(cid string, prefixLen int, alphabet string) error {
+	for _, c := range cid[prefixLen:] {
+		if !strings.ContainsRune(alphabet, c) {
+			return fmt.Errorf("invalid CID %q: unexpected character %q", cid, c)
+		}
+	}
+	return nil
+}
+
+// Read the IPFS gateway from IPFS_GATEWAY, normalized to a base URL without a
+// trailing slash. A bare host is given an https:// scheme.
+func ipfsGatewayFromEnv() string {
+	gateway := strings.TrimRight(getEnv("IPFS_GATEWAY", ""), "/")
+	if gateway != "" && !strings.Contains(gateway, "://") {
+		gateway = "https://" + gateway
+	}
+	return gateway
+}
+
+// Rewrite a bare CID or ipfs:// URI into a full gateway URL when a gateway is
+// configured, e.g. "ipfs://Qm..." becomes "https://gateway/ipfs/Qm...". Empty
+// values and absolute http(s) URLs are returned unchanged.
+func (s *Server) resolveImageURL(image string) string {
+	if s.ipfsGateway == "" || image == "" ||
+		strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://") {
+		return image
+	}
+	return s.ipfsGateway + "/ipfs/" + strings.TrimPrefix(image, "ipfs://")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxIdempotencyKeys      = 10000 // Least recently used keys are evicted beyond this
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodySize   = 1 << 20 // Bodies are buffered for hashing, so keep them small
+)
+
+// Response recorded for an Idempotency-Key. While the first request is still
+// being handled, done is false. Entries expire after the store's TTL either
+// way, so a request that never completes doesn't hold its key forever.
+type idempotentResponse struct {
+	key         string
+	bodyHash    [sha256.Size]byte
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// In-memory LRU of idempotency keys and the responses they produced
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	order   *list.List // Front is most recently used
+	entries map[string]*list.Element
+}
+
+// Create a store remembering keys for ttl; zero disables idempotency handling
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Look up key, reserving it for the caller when it is new or expired. The
+// returned entry is nil when the caller should handle the request.
+func (st *idempotencyStore) reserve(key string, bodyHash [sha256.Size]byte) *idempotentResponse {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if el, ok := st.entries[key]; ok {
+		entry := el.Value.(*idempotentResponse)
+		if time.Now().Before(entry.expires) {
+			st.order.MoveToFront(el)
+			copied := *entry
+			return &copied
+		}
+		st.order.Remove(el)
+		delete(st.entries, key)
+	}
+
+	entry := &idempotentResponse{key: key, bodyHash: bodyHash, expires: time.Now().Add(st.ttl)}
+	st.entries[key] = st.order.PushFront(entry)
+	for st.order.Len() > maxIdempotencyKeys {
+		oldest := st.order.Back()
+		st.order.Remove(oldest)
+		delete(st.entries, oldest.Value.(*idempotentResponse).key)
+	}
+	return nil
+}
+
+// Record the response for a reserved key, or release the key when the
+// response should not be replayed
+func (st *idempotencyStore) complete(key string, status int, contentType string, body []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	el, ok := st.entries[key]
+	if !ok {
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		// Server-side failures are worth retrying, so forget the key
+		st.order.Remove(el)
+		delete(st.entries, key)
+		return
+	}
+	entry := el.Value.(*idempotentResponse)
+	entry.done = true
+	entry.status = status
+	entry.contentType = contentType
+	entry.body = body
+	entry.expires = time.Now().Add(st.ttl)
+}
+
+// Replay the stored response when a request repeats an Idempotency-Key, so
+// that retried creates don't insert twice. Requests without the header are
+// handled normally.
+func (st *idempotencyStore) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if st.ttl <= 0 || key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Idempotency-Key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "Request body is too large")
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Unable to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+
+		if entry := st.reserve(key, bodyHash); entry != nil {
+			switch {
+			case entry.bodyHash != bodyHash:
+				writeJSONError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used with a different request body")
+			case !entry.done:
+				writeJSONError(w, http.StatusConflict, "request_in_progress", "A request with this Idempotency-Key is still in progress")
+			default:
+				w.Header().Set("Content-Type", entry.contentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(entry.status)
+				w.Write(entry.body)
+			}
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		next(capture, r)
+		if capture.status == 0 {
+			capture.status = http.StatusOK
+		}
+		st.complete(key, capture.status, w.Header().Get("Content-Type"), capture.buf.Bytes())
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Configure the process-wide logger from LOG_FORMAT and LOG_LEVEL. With
+// "json", both slog and the standard log package emit structured JSON lines.
+// Lines written with the standard log package are logged at info level.
+func setupLogger() {
+	opts := &slog.HandlerOptions{Level: parseLogLevel(getEnv("LOG_LEVEL", "info"))}
+	format := getEnv("LOG_FORMAT", "text")
+	if format == "json" {
+		slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stderr, opts)}))
+		return
+	}
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewTextHandler(os.Stderr, opts)}))
+	if format != "text" {
+		logWarnf("Unknown LOG_FORMAT %q. Using text logging.", format)
+	}
+}
+
+// Map a LOG_LEVEL value (debug, info, warn, error) to a slog level
+func parseLogLevel(value string) slog.Level {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug
+	case "info", "":
+		return slog.LevelInfo
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	logWarnf("Unknown LOG_LEVEL %q. Using info.", value)
+	return slog.LevelInfo
+}
+
+// Context key holding the ID assigned to a request by the requestID middleware
+type requestIDKey struct{}
+
+// Return the request ID carried by ctx, or "" outside of a request
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Add the request ID, when the context carries one, to each log record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// Log a formatted message at the given level, skipping the formatting work
+// when the level is disabled
+func logf(level slog.Level, format string, args ...interface{}) {
+	logfCtx(context.Background(), level, format, args...)
+}
+
+// Like logf, tagging the line with the request ID carried by ctx
+func logfCtx(ctx context.Context, level slog.Level, format string, args ...interface{}) {
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+// Log a lifecycle event at info level. The event name is attached as the event
+// attribute so log pipelines can match on it regardless of the message text.
+func logEvent(event, message string, attrs ...interface{}) {
+	slog.Info(message, append([]interface{}{"event", event}, attrs...)...)
+}
+
+// Helper functions to log at a specific level
+func logWarnf(format string, args ...interface{})  { logf(slog.LevelWarn, format, args...) }
+func logErrorf(format string, args ...interface{}) { logf(slog.LevelError, format, args...) }
+
+// Variants of the helpers above for code serving a request
+func logDebugfCtx(ctx context.Context, format string, args ...interface{}) {
+	logfCtx(ctx, slog.LevelDebug, format, args...)
+}
+func logInfofCtx(ctx context.Context, format string, args ...interface{}) {
+	logfCtx(ctx, slog.LevelInfo, format, args...)
+}
+func logWarnfCtx(ctx context.Context, format string, args ...interface{}) {
+	logfCtx(ctx, slog.LevelWarn, format, args...)
+}
+func logErrorfCtx(ctx context.Context, format string, args ...interface{}) {
+	logfCtx(ctx, slog.LevelError, format, args...)
+}
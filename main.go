@@ -1,144 +1,2115 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
+// A record as stored and served by the API. Image is optional: a record
+// without one has a NULL image column and is served with "image": null.
 type Record struct {
-	CID   string `json:"cid"`
-	Name  string `json:"name"`
-	Image string `json:"image"`
+	CID       string     `json:"cid"`
+	Name      string     `json:"name"`
+	Image     NullString `json:"image"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // Null until the record is first updated
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // Set while the record is soft-deleted
+	Metadata  Metadata   `json:"metadata,omitempty"`
 }
 
-var db *sql.DB
+// Body of POST /data and of each item of POST /data/bulk. Only the fields a
+// client sets are accepted; the timestamps are managed by the database.
+type RecordInput struct {
+	CID      string   `json:"cid"`
+	Name     string   `json:"name"`
+	Image    *string  `json:"image,omitempty"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// Convert the input into the Record to validate and insert
+func (in RecordInput) record() Record {
+	record := Record{CID: in.CID, Name: in.Name, Metadata: in.Metadata}
+	if in.Image != nil {
+		record.Image = newNullString(*in.Image)
+	}
+	return record
+}
+
+// Body of PUT /data/{cid}. The CID comes from the path, and the image is left
+// unchanged when omitted.
+type RecordUpdate struct {
+	Name  string  `json:"name"`
+	Image *string `json:"image,omitempty"`
+}
+
+// Field length limits enforced by Record.validate
+const (
+	maxCIDLength   = 100
+	maxNameLength  = 512
+	maxImageLength = 2048
+)
+
+// A validation failure for a single Record field
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Check required fields, length limits, and (when checkCID is set) the CID
+// format, returning a *FieldError for the first problem found
+func (r *Record) validate(checkCID bool) error {
+	switch {
+	case r.CID == "":
+		return &FieldError{"cid", "cid is required"}
+	case len(r.CID) > maxCIDLength:
+		return &FieldError{"cid", fmt.Sprintf("cid must be at most %d characters", maxCIDLength)}
+	case r.Name == "":
+		return &FieldError{"name", "name is required"}
+	}
+	if err := checkFieldLengths(r.Name, r.Image.String); err != nil {
+		return err
+	}
+	if checkCID {
+		if err := validateCID(r.CID); err != nil {
+			return &FieldError{"cid", err.Error()}
+		}
+	}
+	return nil
+}
+
+// Check a name and image against their length limits, shared by every write
+// path so none of them can store oversized values
+func checkFieldLengths(name, image string) error {
+	switch {
+	case len(name) > maxNameLength:
+		return &FieldError{"name", fmt.Sprintf("name must be at most %d characters", maxNameLength)}
+	case len(image) > maxImageLength:
+		return &FieldError{"image", fmt.Sprintf("image must be at most %d characters", maxImageLength)}
+	}
+	return nil
+}
+
+// Columns selected for a Record, in the order expected by scanRecord
+const recordColumns = "cid, name, image, created_at, updated_at, metadata, deleted_at"
+
+// Anything that can scan a result row, i.e. *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan a row selected with recordColumns into a Record
+func scanRecord(row rowScanner, record *Record) error {
+	return row.Scan(&record.CID, &record.Name, &record.Image, &record.CreatedAt, &record.UpdatedAt, &record.Metadata, &record.DeletedAt)
+}
+
+// The database operations the query helpers need. *sql.DB and *sql.Tx both
+// satisfy it, as does a sqlmock connection in tests.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Unquoted PostgreSQL identifiers accepted for DB_TABLE
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+
+	maxUploadSize   = 32 << 20 // 32 MiB
+	maxJSONBodySize = 1 << 20  // Single-record and admin JSON bodies
+	maxBulkBodySize = 32 << 20 // Room for maxBulkRecords records at the field length limits
+	maxBulkRecords  = 10000
+
+	maxRetryDelay = 30 * time.Second
+
+	readQueryAttempts = 3
+	readRetryDelay    = 100 * time.Millisecond // Grows linearly with each attempt
+
+	shutdownTimeout    = 10 * time.Second
+	healthCheckTimeout = 2 * time.Second
+	csvFetchTimeout    = 5 * time.Minute
+)
+
+// Known libpq sslmode values accepted for DB_SSLMODE
+var validSSLModes = map[string]bool{
+	"disable":     true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// Content types of the /data response formats
+var formatContentTypes = map[string]string{
+	"json":   "application/json",
+	"map":    "application/json",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+}
+
+// Content types accepted for uploaded CSV files
+var csvContentTypes = map[string]bool{
+	"text/csv":                 true,
+	"application/csv":          true,
+	"application/vnd.ms-excel": true, // Sent by browsers on Windows for .csv files
+}
+
+// Columns that may be used in the ORDER BY clause of /data
+var sortableColumns = map[string]bool{
+	"cid":  true,
+	"name": true,
+}
+
+// Load environment variables from .env file
+func loadEnv() {
+	err := godotenv.Load()
+	// Configure the logger before the first line is written so that LOG_FORMAT
+	// from the .env file applies to all output
+	setupLogger()
+	if err != nil {
+		logWarnf(".env file not found. Using system environment variables.")
+	} else {
+		log.Println("Environment variables loaded successfully from .env file.")
+	}
+}
+
+// Initialize the database connection with retry mechanism and attach it to s
+// once the schema is migrated. The connection string is returned for
+// connections kept outside the pool.
+func (s *Server) initDB() (string, error) {
+	var db *sql.DB
+	var err error
+	if !identifierPattern.MatchString(s.tableName) {
+		return "", fmt.Errorf("invalid DB_TABLE %q: must be a plain SQL identifier", s.tableName)
+	}
+	connStr := buildConnStr()
+
+	attempts := max(getEnvInt("DB_CONNECT_ATTEMPTS", 5), 1)
+	baseDelay := getEnvDuration("DB_RETRY_BASE_DELAY", 2*time.Second)
+	pingTimeout := getEnvDuration("DB_PING_TIMEOUT", 3*time.Second)
+	for i := 0; i < attempts; i++ {
+		db, err = openDB(connStr)
+		if err == nil {
+			if err = pingDB(db, pingTimeout); err == nil {
+				logEvent("db_connected", "Database connection established.", "attempts", i+1)
+				break
+			}
+			db.Close()
+		}
+		if i == attempts-1 {
+			break
+		}
+		delay := backoffDelay(baseDelay, i)
+		logWarnf("Database connection failed (attempt %d/%d): %v. Retrying in %s...", i+1, attempts, err, delay)
+		time.Sleep(delay)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to connect to the database after retries: %w", err)
+	}
+
+	// Configure the connection pool
+	db.SetMaxOpenConns(getEnvInt("DB_MAX_OPEN_CONNS", 25))
+	db.SetMaxIdleConns(getEnvInt("DB_MAX_IDLE_CONNS", 5))
+	db.SetConnMaxLifetime(getEnvDuration("DB_CONN_MAX_LIFETIME", 5*time.Minute))
+
+	// Ensure the table exists and is on the latest schema
+	s.db = db
+	if err := s.applyMigrations(); err != nil {
+		db.Close()
+		s.db = nil
+		return "", err
+	}
+	s.schemaReady.Store(true)
+	logEvent("schema_ready", "Database table initialized successfully.", "table", s.tableName)
+	return connStr, nil
+}
+
+// Compute the delay before the next connection attempt: exponential backoff
+// from base, capped at maxRetryDelay, with equal jitter so that many instances
+// restarting together don't reconnect in lockstep
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Ping the database, giving up after timeout so an unreachable host fails fast
+func pingDB(db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// Derive a context for a single database query from the request, so the query
+// is cancelled when the client disconnects or the query timeout elapses
+func (s *Server) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), s.queryTimeout)
+}
+
+// Build the statement used to insert a single record, leaving existing CIDs
+// untouched. With unique names, a record reusing a name is skipped the same way.
+func (s *Server) insertRecordQuery() string {
+	conflictTarget := " (cid)"
+	if s.uniqueNames {
+		conflictTarget = ""
+	}
+	return `INSERT INTO ` + s.tableName + ` (cid, name, image, metadata)
+        VALUES ($1, $2, $3, $4) ON CONFLICT` + conflictTarget + ` DO NOTHING`
+}
+
+// Build the statement used by upsert imports, refreshing name and image for
+// existing CIDs. With unique names, a record taking another CID's name is
+// skipped rather than failing on the index, which would abort the batch.
+func (s *Server) upsertRecordQuery() string {
+	values := `VALUES ($1, $2, $3, $4)`
+	if s.uniqueNames {
+		values = `SELECT $1::text, $2::text, $3::text, $4::jsonb
+        WHERE NOT EXISTS (SELECT 1 FROM ` + s.tableName + ` WHERE name = $2 AND cid <> $1)`
+	}
+	return `INSERT INTO ` + s.tableName + ` (cid, name, image, metadata)
+        ` + values + ` ON CONFLICT (cid) DO UPDATE
+        SET name = EXCLUDED.name, image = EXCLUDED.image, metadata = EXCLUDED.metadata, updated_at = now()`
+}
+
+// Pick the insert statement for CSV imports from the import mode
+func (s *Server) importQuery() string {
+	if s.importMode == "upsert" {
+		return s.upsertRecordQuery()
+	}
+	return s.insertRecordQuery()
+}
+
+// Build the database connection string, preferring DATABASE_URL when set
+// and otherwise assembling it from the individual DB_* variables
+func buildConnStr() string {
+	params := connParams()
+	if dbURL := getEnv("DATABASE_URL", ""); dbURL != "" {
+		log.Println("Using DATABASE_URL for the database connection.")
+		return withConnParams(dbURL, params)
+	}
+
+	sslMode := getEnv("DB_SSLMODE", "disable")
+	if !validSSLModes[sslMode] {
+		logWarnf("Unknown DB_SSLMODE %q. Expected one of disable, require, verify-ca, verify-full.", sslMode)
+	}
+	return withConnParams(fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		getEnv("DB_HOST", "localhost"),
+		getEnv("DB_PORT", "5432"),
+		getEnv("DB_USER", "postgres"),
+		getEnv("DB_PASSWORD", ""),
+		getEnv("DB_NAME", "postgres"),
+		sslMode,
+	), params)
+}
+
+// Connection parameters that identify this instance in pg_stat_activity
+// (DB_APPLICATION_NAME, defaulting to the binary name) and bound how long
+// connecting may take (DB_CONNECT_TIMEOUT). DB_TIMEZONE optionally sets the
+// session time zone.
+func connParams() [][2]string {
+	connectTimeout := getEnvDuration("DB_CONNECT_TIMEOUT", 10*time.Second)
+	params := [][2]string{
+		{"application_name", getEnv("DB_APPLICATION_NAME", filepath.Base(os.Args[0]))},
+		// libpq takes whole seconds, where 0 means wait forever
+		{"connect_timeout", strconv.Itoa(int((connectTimeout + time.Second - 1) / time.Second))},
+	}
+	if tz := getEnv("DB_TIMEZONE", ""); tz != "" {
+		params = append(params, [2]string{"timezone", tz})
+	}
+	return params
+}
+
+// Add params to a connection string, given either as a postgres:// URL or as
+// key=value pairs. Parameters the string already sets are left alone.
+func withConnParams(connStr string, params [][2]string) string {
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		u, err := url.Parse(connStr)
+		if err != nil {
+			return connStr // Left for sql.Open to report
+		}
+		query := u.Query()
+		for _, p := range params {
+			if !query.Has(p[0]) {
+				query.Set(p[0], p[1])
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+
+	for _, p := range params {
+		if strings.Contains(" "+connStr, " "+p[0]+"=") {
+			continue
+		}
+		// Quote values so names with spaces or quotes survive parsing
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p[1])
+		connStr += " " + p[0] + "='" + value + "'"
+	}
+	return connStr
+}
+
+// Summary of a CSV import run. In upsert mode Inserted also counts rows that
+// overwrote an existing CID, and Conflicted stays zero.
+type ImportSummary struct {
+	Inserted   int `json:"inserted"`
+	Skipped    int `json:"skipped"`
+	Conflicted int `json:"conflicted"`
+	Errored    int `json:"errored"`
+	Duplicates int `json:"duplicates"` // Rows repeating a CID seen earlier in the same file
+	// Batches rolled back after an error; their rows count as errored
+	FailedBatches int  `json:"failed_batches"`
+	DryRun        bool `json:"dry_run,omitempty"`
+}
+
+// A problem with the contents of a CSV file rather than with the database,
+// such as a header without a cid column. Uploads report it as 422 with Code.
+type CSVError struct {
+	Code    string
+	Message string
+}
+
+func (e *CSVError) Error() string {
+	return e.Message
+}
+
+// Add the counts of another import to the summary
+func (sum *ImportSummary) add(other ImportSummary) {
+	sum.Inserted += other.Inserted
+	sum.Skipped += other.Skipped
+	sum.Conflicted += other.Conflicted
+	sum.Errored += other.Errored
+	sum.Duplicates += other.Duplicates
+	sum.FailedBatches += other.FailedBatches
+	sum.DryRun = sum.DryRun || other.DryRun
+}
+
+// Load CSV data and insert it into the database. filePath may also be a
+// directory, whose *.csv files are all imported, or a glob pattern. Failed
+// fetches and imports are returned so the caller decides whether they are
+// fatal; rows committed before the failure are kept and counted in the summary.
+func (s *Server) loadCSVAndInsertData(ctx context.Context, filePath string) (ImportSummary, error) {
+	defer s.csvLoaded.Store(true)
+
+	var summary ImportSummary
+	switch {
+	case filePath == "-":
+		return s.importCSV(ctx, os.Stdin, "stdin")
+	case strings.HasPrefix(filePath, "http://") || strings.HasPrefix(filePath, "https://"):
+		body, err := fetchCSV(ctx, filePath)
+		if err != nil {
+			return summary, fmt.Errorf("unable to fetch CSV from %s: %w", filePath, err)
+		}
+		defer body.Close()
+		// Batches committed before a dropped connection are kept; the one in
+		// flight is rolled back
+		return s.importCSV(ctx, body, filePath)
+	}
+
+	// A glob or directory imports every matching file in sorted order
+	var files []string
+	if strings.ContainsAny(filePath, "*?[") {
+		matches, err := filepath.Glob(filePath)
+		if err != nil {
+			return summary, fmt.Errorf("invalid CSV path pattern %q: %w", filePath, err)
+		}
+		files = matches
+	} else if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(filePath, "*.csv")) // Only fails on a malformed pattern
+	} else {
+		if os.IsNotExist(err) {
+			logInfofCtx(ctx, "CSV file not found: %s. Skipping data insertion.", filePath)
+			return summary, nil
+		}
+		return s.importCSVFile(ctx, filePath)
+	}
+
+	if len(files) == 0 {
+		logInfofCtx(ctx, "No CSV files match %s. Skipping data insertion.", filePath)
+		return summary, nil
+	}
+	slices.Sort(files)
+	failed := 0
+	for _, file := range files {
+		fileSummary, err := s.importCSVFile(ctx, file)
+		summary.add(fileSummary)
+		if err != nil {
+			// Keep going so one bad file doesn't hold back the rest
+			logErrorfCtx(ctx, "CSV import of %s failed: %v", file, err)
+			failed++
+		}
+	}
+	logInfofCtx(ctx, "Imported %d of %d CSV files from %s: %d inserted, %d skipped, %d conflicted, %d errored, %d duplicates.",
+		len(files)-failed, len(files), filePath,
+		summary.Inserted, summary.Skipped, summary.Conflicted, summary.Errored, summary.Duplicates)
+	if failed > 0 {
+		return summary, fmt.Errorf("%d of %d CSV files from %s failed to import", failed, len(files), filePath)
+	}
+	return summary, nil
+}
+
+// Open and import a single CSV file
+func (s *Server) importCSVFile(ctx context.Context, filePath string) (ImportSummary, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ImportSummary{}, fmt.Errorf("unable to open CSV file: %w", err)
+	}
+	defer file.Close()
+
+	return s.importCSV(ctx, file, filePath)
+}
+
+// Start downloading a CSV file over HTTP(S). The caller streams and closes the
+// returned body; anything other than 200 OK is treated as an error.
+func fetchCSV(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: getEnvDuration("CSV_FETCH_TIMEOUT", csvFetchTimeout)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Wrap r to transcode from CSV_ENCODING (any WHATWG label such as "latin1" or
+// "windows-1252", default UTF-8) to UTF-8. A leading byte order mark is
+// always stripped, and overrides the configured encoding when present.
+func csvDecoder(r io.Reader) io.Reader {
+	name := getEnv("CSV_ENCODING", "utf-8")
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		logWarnf("Unknown CSV_ENCODING %q. Using utf-8.", name)
+		enc = unicode.UTF8
+	}
+	return transform.NewReader(r, unicode.BOMOverride(enc.NewDecoder()))
+}
+
+// Read the field delimiter from CSV_DELIMITER, defaulting to a comma. The
+// token \t stands for a tab since that is awkward to put in an env file.
+func csvDelimiter() rune {
+	value := getEnv("CSV_DELIMITER", ",")
+	if value == `\t` {
+		return '\t'
+	}
+	delim, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || delim == utf8.RuneError || delim == '"' || delim == '\r' || delim == '\n' {
+		logWarnf("Invalid CSV_DELIMITER %q: expected a single character. Using \",\".", value)
+		return ','
+	}
+	return delim
+}
+
+// A raw CSV row along with its 1-based line number in the source file
+type csvRow struct {
+	line   int
+	fields []string
+}
+
+// Positions of the record fields within a CSV row. Image is -1 when the file
+// has no image column.
+type csvColumns struct {
+	CID, Name, Image int
+}
+
+// Work out which CSV columns hold cid, name, and image. CSV_COL_CID,
+// CSV_COL_NAME, and CSV_COL_IMAGE (0-based) take precedence; otherwise the
+// columns are looked up by name in the header row, or default to the order
+// cid, name, image when the file has no header.
+func resolveCSVColumns(header []string) (csvColumns, error) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	resolve := func(field, envKey string, fallback int) (int, error) {
+		pos := getEnvInt(envKey, -1)
+		switch {
+		case pos >= 0:
+		case header == nil:
+			pos = fallback
+		default:
+			var ok bool
+			if pos, ok = positions[field]; !ok {
+				return 0, &CSVError{"missing_csv_column", fmt.Sprintf("CSV header has no %q column; rename it or set %s", field, envKey)}
+			}
+		}
+		if header != nil && pos >= len(header) {
+			return 0, &CSVError{"invalid_csv_column", fmt.Sprintf("%s=%d is out of range for a CSV header with %d columns", envKey, pos, len(header))}
+		}
+		return pos, nil
+	}
+
+	var cols csvColumns
+	var err error
+	if cols.CID, err = resolve("cid", "CSV_COL_CID", 0); err != nil {
+		return cols, err
+	}
+	if cols.Name, err = resolve("name", "CSV_COL_NAME", 1); err != nil {
+		return cols, err
+	}
+	if _, ok := positions["image"]; header != nil && !ok && getEnvInt("CSV_COL_IMAGE", -1) < 0 {
+		cols.Image = -1 // Images are optional, so a header without one is fine
+		return cols, nil
+	}
+	if cols.Image, err = resolve("image", "CSV_COL_IMAGE", 2); err != nil {
+		return cols, err
+	}
+	return cols, nil
+}
+
+// Collect the non-empty values of unmapped CSV columns as metadata, keyed by
+// their header names. Files without a header carry no metadata.
+func extraColumns(header, row []string, cols csvColumns) Metadata {
+	var metadata Metadata
+	for i, key := range header {
+		if i == cols.CID || i == cols.Name || i == cols.Image || i >= len(row) || row[i] == "" {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(Metadata)
+		}
+		metadata[strings.TrimSpace(key)] = row[i]
+	}
+	return metadata
+}
+
+// Parse CSV data from r and insert it into the database. The source name is
+// only used for logging.
+func (s *Server) importCSV(ctx context.Context, r io.Reader, source string) (ImportSummary, error) {
+	var summary ImportSummary
+	input := &countingReader{r: r}
+	s.progress.start(source, input, inputSize(r))
+	defer s.progress.finish()
+	progressEvery := getEnvInt("IMPORT_PROGRESS_EVERY", 10000) // Rows between progress log lines; 0 disables them
+
+	reader := csv.NewReader(csvDecoder(input))
+	reader.Comma = csvDelimiter()
+	// Allow ragged rows; rows missing required columns are skipped individually
+	reader.FieldsPerRecord = -1
+	logInfofCtx(ctx, "Using CSV delimiter %q.", reader.Comma)
+
+	var header []string
+	if getEnvBool("CSV_HAS_HEADER", true) {
+		var err error
+		header, err = reader.Read()
+		if err == io.EOF {
+			logInfofCtx(ctx, "CSV file is empty: %s. Skipping data insertion.", source)
+			return summary, nil
+		}
+		if err != nil {
+			return summary, fmt.Errorf("unable to read CSV header: %w", err)
+		}
+	}
+	cols, err := resolveCSVColumns(header)
+	if err != nil {
+		return summary, err
+	}
+	minFields := max(cols.CID, cols.Name) + 1 // The image column is optional
+
+	maxDuplicates := getEnvInt("CSV_MAX_DUPLICATES", -1) // Negative disables the limit
+	seen := make(map[string]int)                         // CID -> first line it appeared on
+
+	// In dry-run mode every row is parsed and validated, but nothing is written
+	// and valid rows are counted as inserted
+	summary.DryRun = getEnvBool("DRY_RUN", false)
+
+	// Rows are committed in batches of IMPORT_BATCH_SIZE, each in its own
+	// transaction, so locks are held briefly and finished batches survive a
+	// failure later in the file
+	batchSize := max(getEnvInt("IMPORT_BATCH_SIZE", 1000), 1)
+	workers := max(getEnvInt("WORKERS", runtime.NumCPU()), 1)
+
+	var mu sync.Mutex // Guards seen and the batch summary
+	importRow := func(ctx context.Context, stmt *sql.Stmt, result *ImportSummary, row csvRow) error {
+		if len(row.fields) < minFields { // Ensure all required fields are present
+			logWarnfCtx(ctx, "Skipping invalid record at line %d: %v", row.line, row.fields)
+			mu.Lock()
+			result.Skipped++
+			mu.Unlock()
+			return nil
+		}
+		cid, name := row.fields[cols.CID], row.fields[cols.Name]
+		var image NullString // Rows without an image column get a NULL image
+		if cols.Image >= 0 && cols.Image < len(row.fields) {
+			image = newNullString(row.fields[cols.Image])
+		}
+		if err := (&Record{CID: cid, Name: name, Image: image}).validate(s.validateCIDs); err != nil {
+			logWarnfCtx(ctx, "Skipping invalid record at line %d: %v", row.line, err)
+			mu.Lock()
+			result.Skipped++
+			mu.Unlock()
+			return nil
+		}
+
+		mu.Lock()
+		if firstSeen, ok := seen[cid]; ok {
+			logWarnfCtx(ctx, "Duplicate CID %s at line %d (first seen at line %d)", cid, row.line, firstSeen)
+			result.Duplicates++
+		} else {
+			seen[cid] = row.line
+		}
+		if summary.DryRun {
+			result.Inserted++
+		}
+		mu.Unlock()
+		if summary.DryRun {
+			return nil
+		}
+
+		// A failed statement aborts the whole Postgres transaction, so stop here
+		res, err := stmt.ExecContext(ctx, cid, name, image, extraColumns(header, row.fields, cols))
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			result.Errored++
+			return fmt.Errorf("error inserting record (line %d): %w", row.line, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			result.Conflicted++
+			return nil
+		}
+		result.Inserted++
+		return nil
+	}
+
+	// Import one batch in its own transaction with a prepared statement shared
+	// by a pool of workers. The transaction serializes the inserts on its
+	// connection while validation runs in parallel. A failed batch is rolled
+	// back, and the rows it would have written count as errored.
+	importBatch := func(batch []csvRow) (ImportSummary, error) {
+		result := ImportSummary{DryRun: summary.DryRun}
+		attempted := 0
+		fail := func(err error) (ImportSummary, error) {
+			result.Errored += result.Inserted + result.Conflicted + len(batch) - attempted
+			result.Inserted, result.Conflicted = 0, 0
+			result.FailedBatches = 1
+			return result, err
+		}
+
+		var tx *sql.Tx
+		var stmt *sql.Stmt
+		if !summary.DryRun {
+			var err error
+			if tx, err = s.db.BeginTx(ctx, nil); err != nil {
+				return fail(fmt.Errorf("unable to begin import transaction: %w", err))
+			}
+			defer tx.Rollback() // No-op once the transaction has been committed
+
+			if stmt, err = tx.PrepareContext(ctx, s.importQuery()); err != nil {
+				return fail(fmt.Errorf("unable to prepare insert statement: %w", err))
+			}
+			defer stmt.Close()
+		}
+
+		batchCtx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		queues := make([]chan csvRow, workers)
+		var wg sync.WaitGroup
+		for i := range queues {
+			queue := make(chan csvRow)
+			queues[i] = queue
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for row := range queue {
+					if err := importRow(batchCtx, stmt, &result, row); err != nil {
+						cancel(err)
+						return
+					}
+				}
+			}()
+		}
+		// Rows sharing a CID always go to the same worker, which runs them in
+		// file order, so in upsert mode the last of them is the one stored
+		queueFor := func(row csvRow) chan<- csvRow {
+			if cols.CID >= len(row.fields) {
+				return queues[0]
+			}
+			h := fnv.New32a()
+			h.Write([]byte(row.fields[cols.CID]))
+			return queues[h.Sum32()%uint32(len(queues))]
+		}
+	send:
+		for _, row := range batch {
+			select {
+			case queueFor(row) <- row:
+				attempted++
+			case <-batchCtx.Done():
+				break send
+			}
+		}
+		for _, queue := range queues {
+			close(queue)
+		}
+		wg.Wait()
+		if err := context.Cause(batchCtx); err != nil {
+			return fail(err)
+		}
+
+		if duplicates := summary.Duplicates + result.Duplicates; maxDuplicates >= 0 && duplicates > maxDuplicates {
+			return fail(&CSVError{"too_many_duplicates", fmt.Sprintf("found %d duplicate CIDs in %s, more than the allowed %d", duplicates, source, maxDuplicates)})
+		}
+		if tx != nil {
+			if err := tx.Commit(); err != nil {
+				return fail(fmt.Errorf("unable to commit import batch: %w", err))
+			}
+		}
+		return result, nil
+	}
+
+	// Run the pending batch and add its results to the summary. A failed batch
+	// only stops the import when the rest would fail too: the database is gone,
+	// the import was cancelled, or the duplicate limit was exceeded.
+	batch := make([]csvRow, 0, batchSize)
+	batches := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		batches++
+		first, last := batch[0].line, batch[len(batch)-1].line
+		result, err := importBatch(batch)
+		batch = batch[:0]
+		summary.add(result)
+		if result.Inserted > 0 || result.Conflicted > 0 {
+			s.cache.invalidate()
+		}
+		if err != nil {
+			var csvErr *CSVError
+			if ctx.Err() != nil || isDBUnavailable(err) || isTransientDBError(err) || errors.As(err, &csvErr) {
+				return err
+			}
+			logErrorfCtx(ctx, "Import batch %d (lines %d-%d) failed and was rolled back: %v. Continuing with the next batch.",
+				batches, first, last, err)
+			return nil
+		}
+		logInfofCtx(ctx, "Import batch %d (lines %d-%d) done: %d inserted, %d skipped, %d conflicted, %d duplicates.",
+			batches, first, last, result.Inserted, result.Skipped, result.Conflicted, result.Duplicates)
+		return nil
+	}
+
+	// Stream the file one row at a time so memory use is bounded by the batch
+	// size rather than the file
+	start := time.Now()
+	rowCount := 0
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				logWarnfCtx(ctx, "Skipping malformed record at line %d: %v", parseErr.Line, parseErr.Err)
+				summary.Skipped++
+				continue
+			}
+			return summary, fmt.Errorf("unable to read CSV file: %w", err)
+		}
+		rowCount++
+		s.progress.setRows(rowCount)
+		if progressEvery > 0 && rowCount%progressEvery == 0 {
+			logInfofCtx(ctx, "%s", s.progress.snapshot())
+		}
+		line, _ := reader.FieldPos(0)
+		if batch = append(batch, csvRow{line: line, fields: fields}); len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return summary, err
+	}
+
+	if summary.DryRun {
+		logInfofCtx(ctx, "Dry run of %s complete; no rows were written.", source)
+	}
+	elapsed := time.Since(start)
+	logInfofCtx(ctx, "CSV import finished in %s (%.0f rows/s): %d inserted, %d skipped, %d conflicted, %d errored, %d duplicates, %d of %d batches failed.",
+		elapsed.Round(time.Millisecond), float64(rowCount)/elapsed.Seconds(),
+		summary.Inserted, summary.Skipped, summary.Conflicted, summary.Errored, summary.Duplicates, summary.FailedBatches, batches)
+	return summary, nil
+}
+
+// Aggregates over the records matching a filter, used for X-Total-Count and
+// the ETag
+type recordSummary struct {
+	Total      int64
+	MaxID      int64
+	LastChange *time.Time
+}
+
+// Count the records matching the WHERE clause and collect what the ETag is
+// derived from. The latest change is taken over the whole table, since soft
+// deletes and edits that move a record out of the filter leave no trace among
+// the matching rows.
+func (s *Server) summarizeRecords(ctx context.Context, q querier, where string, args []interface{}) (recordSummary, error) {
+	var sum recordSummary
+	err := q.QueryRowContext(ctx, `
+        SELECT COUNT(*), COALESCE(MAX(id), 0),
+            (SELECT MAX(GREATEST(created_at, updated_at, deleted_at)) FROM `+s.tableName+`)
+        FROM `+s.tableName+where, args...).Scan(&sum.Total, &sum.MaxID, &sum.LastChange)
+	return sum, err
+}
+
+// Select one page of the records matching the WHERE clause. The caller closes
+// the returned rows.
+func (s *Server) queryRecordPage(ctx context.Context, q querier, where string, args []interface{}, orderBy string, limit, offset int) (*sql.Rows, error) {
+	query := fmt.Sprintf(`SELECT %s FROM %s%s ORDER BY %s LIMIT $%d OFFSET $%d`,
+		recordColumns, s.tableName, where, orderBy, len(args)+1, len(args)+2)
+	return q.QueryContext(ctx, query, append(args, limit, offset)...)
+}
+
+// Handle API requests to fetch data. HEAD requests get the same headers
+// without the body.
+func (s *Server) fetchDataHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset := parsePagination(r)
+	orderBy, err := parseSort(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_sort", err.Error())
+		return
+	}
+
+	where, args := buildRecordFilter(r)
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	stats, err := retryRead(ctx, func() (recordSummary, error) {
+		defer s.logSlowQuery(ctx, "summarize_records", time.Now())
+		return s.summarizeRecords(ctx, s.db, where, args)
+	})
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error counting records: %v", err)
+		s.respondDBError(w, err, "Unable to fetch records")
+		return
+	}
+
+	format := "json"
+	if prefersCSV(r) {
+		format = "csv"
+	} else if r.URL.Query().Get("format") == "ndjson" {
+		format = "ndjson"
+	} else if r.URL.Query().Get("shape") == "map" {
+		format = "map"
+	}
+	// The format is negotiated from Accept, so shared caches must key on it
+	w.Header().Add("Vary", "Accept")
+	etag := s.dataETag(r, stats.Total, stats.MaxID, stats.LastChange, format)
+	w.Header().Set("ETag", etag)
+	lastModified := ""
+	if stats.LastChange != nil {
+		lastModified = stats.LastChange.UTC().Format(http.TimeFormat)
+		w.Header().Set("Last-Modified", lastModified)
+	}
+	if isNotModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.FormatInt(stats.Total, 10))
+	// Hard cap on the rows returned, independent of the page size requested
+	if s.maxResultRows > 0 && limit > s.maxResultRows {
+		limit = s.maxResultRows
+		if int64(offset+limit) < stats.Total {
+			w.Header().Set("X-Result-Truncated", "true")
+		}
+	}
+	if r.Method == http.MethodHead {
+		// Probes only need the headers, so skip fetching the page itself
+		w.Header().Set("Content-Type", formatContentTypes[format])
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rows, err := retryRead(ctx, func() (*sql.Rows, error) {
+		defer s.logSlowQuery(ctx, "fetch_page", time.Now())
+		return s.queryRecordPage(ctx, s.db, where, args, orderBy, limit, offset)
+	})
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error fetching records: %v", err)
+		s.respondDBError(w, err, "Unable to fetch records")
+		return
+	}
+	defer rows.Close()
+
+	if format == "csv" {
+		if err := writeRecordsCSV(w, rows); err != nil {
+			logErrorfCtx(r.Context(), "Error streaming CSV response: %v", err)
+			return
+		}
+		logDebugfCtx(r.Context(), "Data fetched and returned successfully as CSV.")
+		return
+	}
+
+	var meta *pageMeta
+	if s.responseEnvelope {
+		meta = &pageMeta{
+			Total:     stats.Total,
+			Limit:     limit,
+			Offset:    offset,
+			Truncated: w.Header().Get("X-Result-Truncated") != "",
+		}
+	}
+	if err := s.writeRecordsJSON(w, rows, format, meta); err != nil {
+		logErrorfCtx(r.Context(), "Error streaming JSON response: %v", err)
+		return
+	}
+	logDebugfCtx(r.Context(), "Data fetched and returned successfully.")
+}
+
+// Stream rows selected with recordColumns to w, encoding one record at a
+// time. format is "json" for an array, "ndjson" for newline-delimited JSON, or
+// "map" for an object keyed by CID; CIDs are unique, so no key repeats. Once
+// the first byte is written the status can no longer change, so errors after
+// that point truncate the response.
+func (s *Server) writeRecordsJSON(w http.ResponseWriter, rows *sql.Rows, format string, meta *pageMeta) error {
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	ndjson := format == "ndjson"
+	open, close := "[", "]"
+	if format == "map" {
+		open, close = "{", "}"
+	}
+	if meta != nil {
+		open = `{"data":` + open
+	}
+	if !ndjson {
+		if _, err := io.WriteString(w, open); err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	for first := true; rows.Next(); first = false {
+		var record Record
+		if err := scanRecord(rows, &record); err != nil {
+			return err
+		}
+		record.Image.String = s.resolveImageURL(record.Image.String)
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		if format == "map" {
+			key, err := json.Marshal(record.CID)
+			if err != nil {
+				return err
+			}
+			b = append(append(key, ':'), b...)
+		}
+		switch {
+		case ndjson:
+			b = append(b, '\n')
+		case !first:
+			b = append([]byte{','}, b...)
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case ndjson:
+		return nil
+	case meta != nil:
+		// The meta object goes last since the row count is only known now
+		meta.Count = count
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s,\"meta\":%s}\n", close, b)
+		return err
+	default:
+		_, err := io.WriteString(w, close+"\n")
+		return err
+	}
+}
+
+// Pagination details sent alongside the records when RESPONSE_ENVELOPE is on
+type pageMeta struct {
+	Count     int   `json:"count"` // Records in this page
+	Total     int64 `json:"total"` // Records matching the filter
+	Limit     int   `json:"limit"`
+	Offset    int   `json:"offset"`
+	Truncated bool  `json:"truncated,omitempty"`
+}
+
+// Handle API requests for the total number of records, honoring the same
+// filters as /data
+func (s *Server) countHandler(w http.ResponseWriter, r *http.Request) {
+	where, args := buildRecordFilter(r)
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	count, err := retryRead(ctx, func() (int, error) {
+		defer s.logSlowQuery(ctx, "count_records", time.Now())
+		var count int
+		err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+s.tableName+where, args...).Scan(&count)
+		return count, err
+	})
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error counting records: %v", err)
+		s.respondDBError(w, err, "Unable to count records")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"count": count})
+}
+
+// Handle API requests to export all records as a CSV attachment
+func (s *Server) exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	// No query or write timeout here: large exports may stream for a long time,
+	// but they are still cancelled when the client goes away
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	rows, err := retryRead(r.Context(), func() (*sql.Rows, error) {
+		defer s.logSlowQuery(r.Context(), "export_records", time.Now())
+		return s.db.QueryContext(r.Context(), `SELECT `+recordColumns+` FROM `+s.tableName+` WHERE `+notDeleted+` ORDER BY id ASC`)
+	})
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error fetching records for export: %v", err)
+		s.respondDBError(w, err, "Unable to fetch records")
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Disposition", `attachment; filename="records.csv"`)
+	if err := writeRecordsCSV(w, rows); err != nil {
+		logErrorfCtx(r.Context(), "Error streaming CSV export: %v", err)
+		return
+	}
+	logDebugfCtx(r.Context(), "Records exported as CSV successfully.")
+}
+
+// Stream rows selected with recordColumns to w as CSV with a header row, without
+// buffering the full result set in memory. Only cid, name, and image are written
+// so the output can be imported again.
+func writeRecordsCSV(w http.ResponseWriter, rows *sql.Rows) error {
+	w.Header().Set("Content-Type", formatContentTypes["csv"])
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"cid", "name", "image"}); err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var record Record
+		if err := scanRecord(rows, &record); err != nil {
+			return err
+		}
+		if err := writer.Write([]string{record.CID, record.Name, record.Image.String}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// Report whether the Accept header prefers text/csv over JSON. JSON stays the
+// default for */*, unknown types, and a missing header.
+func prefersCSV(r *http.Request) bool {
+	csvQ, jsonQ := 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		switch mediaType {
+		case "text/csv":
+			csvQ = max(csvQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return csvQ > 0 && csvQ > jsonQ
+}
+
+// Parse the limit and offset query parameters, falling back to defaults on invalid input
+func parsePagination(r *http.Request) (limit, offset int) {
+	limit = defaultPageLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v >= 0 {
+		offset = v
+	}
+	return limit, offset
+}
+
+// Parse the sort query parameter into an ORDER BY clause, e.g. "name" or "-name" for descending
+func parseSort(r *http.Request) (string, error) {
+	sort := r.URL.Query().Get("sort")
+	if sort == "" {
+		return "id ASC", nil
+	}
+
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
+		sort = sort[1:]
+	}
+	if !sortableColumns[sort] {
+		return "", fmt.Errorf("unsupported sort field %q: allowed fields are cid and name", sort)
+	}
+	return sort + " " + direction + ", id ASC", nil
+}
+
+// Condition matching records that have not been soft-deleted
+const notDeleted = "deleted_at IS NULL"
+
+// Report whether the request asked for soft-deleted records too
+func includeDeleted(r *http.Request) bool {
+	include, _ := strconv.ParseBool(r.URL.Query().Get("include_deleted"))
+	return include
+}
+
+// Build the WHERE clause and its arguments from the filter query parameters of
+// /data. Soft-deleted records are left out unless include_deleted is set.
+func buildRecordFilter(r *http.Request) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if !includeDeleted(r) {
+		conditions = append(conditions, notDeleted)
+	}
+
+	if name := r.URL.Query().Get("name"); name != "" {
+		args = append(args, escapeLike(name))
+		conditions = append(conditions, fmt.Sprintf(`name ILIKE '%%' || $%d || '%%'`, len(args)))
+	}
+
+	if hasImage, err := strconv.ParseBool(r.URL.Query().Get("has_image")); err == nil {
+		if hasImage {
+			conditions = append(conditions, `image IS NOT NULL AND image <> ''`)
+		} else {
+			conditions = append(conditions, `(image IS NULL OR image = '')`)
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Escape LIKE wildcards so the search term is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Handle API requests to fetch a single record by CID
+func (s *Server) fetchRecordByCIDHandler(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimSpace(r.PathValue("cid"))
+	if cid == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_cid", "CID is required")
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	query := `SELECT ` + recordColumns + ` FROM ` + s.tableName + ` WHERE cid = $1`
+	if !includeDeleted(r) {
+		query += ` AND ` + notDeleted
+	}
+	record, err := retryRead(ctx, func() (Record, error) {
+		defer s.logSlowQuery(ctx, "get_record", time.Now())
+		var record Record
+		err := scanRecord(s.db.QueryRowContext(ctx, query, cid), &record)
+		return record, err
+	})
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
+	}
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error fetching record %s: %v", cid, err)
+		s.respondDBError(w, err, "Unable to fetch record")
+		return
+	}
+
+	record.Image.String = s.resolveImageURL(record.Image.String)
+	writeJSON(w, http.StatusOK, record)
+	logDebugfCtx(r.Context(), "Record %s fetched and returned successfully.", cid)
+}
+
+// Handle API requests to create a new record from a JSON body
+func (s *Server) createRecordHandler(w http.ResponseWriter, r *http.Request) {
+	var input RecordInput
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+	if !decodeJSONBody(w, r, &input, "Malformed JSON body") {
+		return
+	}
+	record := input.record()
+	if err := s.prepareNewRecord(&record); err != nil {
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			writeJSON(w, http.StatusUnprocessableEntity, errorResponse{
+				Error: fieldErr.Message,
+				Code:  "validation_failed",
+				Field: fieldErr.Field,
+			})
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	// Read the stored row back so the response carries created_at like every
+	// other read of the record. No row means the insert was skipped.
+	start := time.Now()
+	err := scanRecord(s.db.QueryRowContext(ctx, s.insertRecordQuery()+` RETURNING `+recordColumns,
+		record.CID, record.Name, record.Image, record.Metadata), &record)
+	s.logSlowQuery(ctx, "create_record", start)
+	if err == sql.ErrNoRows {
+		if s.uniqueNames && !s.cidExists(ctx, record.CID) {
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "Record with this name already exists", Code: "duplicate_name", Field: "name"})
+			return
+		}
+		writeJSONError(w, http.StatusConflict, "duplicate_cid", "Record with this CID already exists")
+		return
+	}
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error inserting record %s: %v", record.CID, err)
+		s.respondDBError(w, err, "Unable to create record")
+		return
+	}
+
+	record.Image.String = s.resolveImageURL(record.Image.String)
+	writeJSON(w, http.StatusCreated, record)
+	logDebugfCtx(r.Context(), "Record %s created successfully.", record.CID)
+}
+
+// Report whether a record with cid exists, to tell whether a skipped insert
+// clashed on its CID or its name. Errors report true, falling back to the
+// duplicate CID response.
+func (s *Server) cidExists(ctx context.Context, cid string) bool {
+	defer s.logSlowQuery(ctx, "cid_exists", time.Now())
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+s.tableName+` WHERE cid = $1)`, cid).Scan(&exists); err != nil {
+		logErrorfCtx(ctx, "Error checking for CID %s: %v", cid, err)
+		return true
+	}
+	return exists
+}
+
+// Handle API requests for a random sample of records. count defaults to
+// RANDOM_DEFAULT_COUNT and is capped at RANDOM_MAX_COUNT. ORDER BY random()
+// scans the whole table, so this is meant for sampling rather than hot paths.
+func (s *Server) randomRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	count := s.randomCount
+	if v, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && v > 0 {
+		count = v
+	}
+	count = min(count, s.maxRandomCount)
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	rows, err := retryRead(ctx, func() (*sql.Rows, error) {
+		defer s.logSlowQuery(ctx, "random_records", time.Now())
+		return s.db.QueryContext(ctx, `SELECT `+recordColumns+` FROM `+s.tableName+` WHERE `+notDeleted+` ORDER BY random() LIMIT $1`, count)
+	})
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error fetching random records: %v", err)
+		s.respondDBError(w, err, "Unable to fetch records")
+		return
+	}
+	defer rows.Close()
+
+	if err := s.writeRecordsJSON(w, rows, "json", nil); err != nil {
+		logErrorfCtx(r.Context(), "Error streaming random records: %v", err)
+	}
+}
+
+// Handle API requests to fetch the records matching a list of CIDs, reporting
+// the requested CIDs that were not found
+func (s *Server) lookupRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CIDs []string `json:"cids"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBodySize)
+	if !decodeJSONBody(w, r, &body, "Malformed JSON body") {
+		return
+	}
+	if len(body.CIDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "cids must be a non-empty array")
+		return
+	}
+	if len(body.CIDs) > maxBulkRecords {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_many_records", fmt.Sprintf("Too many CIDs: at most %d are accepted per request", maxBulkRecords))
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	rows, err := retryRead(ctx, func() (*sql.Rows, error) {
+		defer s.logSlowQuery(ctx, "lookup_records", time.Now())
+		return s.db.QueryContext(ctx, `SELECT `+recordColumns+` FROM `+s.tableName+` WHERE cid = ANY($1) AND `+notDeleted+` ORDER BY id ASC`,
+			pq.Array(body.CIDs))
+	})
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error looking up records: %v", err)
+		s.respondDBError(w, err, "Unable to fetch records")
+		return
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	found := make(map[string]bool, len(body.CIDs))
+	for rows.Next() {
+		var record Record
+		if err := scanRecord(rows, &record); err != nil {
+			logErrorfCtx(r.Context(), "Error scanning row: %v", err)
+			s.respondDBError(w, err, "Error reading data")
+			return
+		}
+		found[record.CID] = true
+		record.Image.String = s.resolveImageURL(record.Image.String)
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		logErrorfCtx(r.Context(), "Error reading lookup results: %v", err)
+		s.respondDBError(w, err, "Error reading data")
+		return
+	}
+
+	notFound := []string{}
+	for _, cid := range body.CIDs {
+		if !found[cid] {
+			notFound = append(notFound, cid)
+			found[cid] = true // Report each missing CID once
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"records": records, "not_found": notFound})
+	logDebugfCtx(r.Context(), "Lookup of %d CIDs returned %d records.", len(body.CIDs), len(records))
+}
+
+// Result of inserting a single record through POST /data/bulk
+type BulkInsertResult struct {
+	CID    string `json:"cid"`
+	Status string `json:"status"` // inserted, conflicted, or invalid
+	Error  string `json:"error,omitempty"`
+}
+
+// Handle API requests to insert a JSON array of records in a single transaction
+func (s *Server) bulkCreateRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	var inputs []RecordInput
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBodySize)
+	if !decodeJSONBody(w, r, &inputs, "Malformed JSON body: expected an array of records") {
+		return
+	}
+	if len(inputs) > maxBulkRecords {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_many_records", fmt.Sprintf("Too many records: at most %d are accepted per request", maxBulkRecords))
+		return
+	}
+
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error starting bulk insert transaction: %v", err)
+		s.respondDBError(w, err, "Unable to create records")
+		return
+	}
+	defer tx.Rollback() // No-op once the transaction has been committed
+
+	stmt, err := tx.PrepareContext(r.Context(), s.insertRecordQuery())
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error preparing bulk insert statement: %v", err)
+		s.respondDBError(w, err, "Unable to create records")
+		return
+	}
+	defer stmt.Close()
 
-// Load environment variables from .env file
-func loadEnv() {
-	err := godotenv.Load()
+	results := make([]BulkInsertResult, 0, len(inputs))
+	for _, input := range inputs {
+		record := input.record()
+		if err := s.prepareNewRecord(&record); err != nil {
+			results = append(results, BulkInsertResult{CID: record.CID, Status: "invalid", Error: err.Error()})
+			continue
+		}
+
+		start := time.Now()
+		result, err := stmt.ExecContext(r.Context(), record.CID, record.Name, record.Image, record.Metadata)
+		s.logSlowQuery(r.Context(), "bulk_create_record", start)
+		if err != nil {
+			logErrorfCtx(r.Context(), "Error inserting record %s in bulk request: %v", record.CID, err)
+			s.respondDBError(w, err, "Unable to create records")
+			return
+		}
+		status := "inserted"
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			status = "conflicted"
+		}
+		results = append(results, BulkInsertResult{CID: record.CID, Status: status})
+	}
+
+	if err := tx.Commit(); err != nil {
+		logErrorfCtx(r.Context(), "Error committing bulk insert: %v", err)
+		s.respondDBError(w, err, "Unable to create records")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+	logDebugfCtx(r.Context(), "Bulk insert of %d records processed successfully.", len(inputs))
+}
+
+// Normalize a record received through the API and validate it for insertion
+func (s *Server) prepareNewRecord(record *Record) error {
+	record.CID = strings.TrimSpace(record.CID)
+	record.Name = strings.TrimSpace(record.Name)
+	return record.validate(s.validateCIDs)
+}
+
+// Handle API requests to delete all records matching a list of CIDs,
+// reporting how many were removed
+func (s *Server) bulkDeleteRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CIDs []string `json:"cids"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBodySize)
+	if !decodeJSONBody(w, r, &body, "Malformed JSON body") {
+		return
+	}
+	if len(body.CIDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "cids must be a non-empty array")
+		return
+	}
+	if len(body.CIDs) > maxBulkRecords {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_many_records", fmt.Sprintf("Too many CIDs: at most %d are accepted per request", maxBulkRecords))
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	// A single statement runs in its own transaction, so either every matching
+	// row is deleted or none are
+	start := time.Now()
+	result, err := s.db.ExecContext(ctx, `UPDATE `+s.tableName+` SET deleted_at = now() WHERE cid = ANY($1) AND `+notDeleted,
+		pq.Array(body.CIDs))
+	s.logSlowQuery(ctx, "bulk_delete_records", start)
 	if err != nil {
-		log.Println("Warning: .env file not found. Using system environment variables.")
-	} else {
-		log.Println("Environment variables loaded successfully from .env file.")
+		logErrorfCtx(r.Context(), "Error deleting records in bulk: %v", err)
+		s.respondDBError(w, err, "Unable to delete records")
+		return
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error reading affected rows for bulk delete: %v", err)
+		s.respondDBError(w, err, "Unable to delete records")
+		return
 	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
+	logInfofCtx(r.Context(), "Bulk delete of %d CIDs removed %d records: %s.", len(body.CIDs), deleted, strings.Join(body.CIDs, ", "))
 }
 
-// Initialize the database connection with retry mechanism
-func initDB() {
-	var err error
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		getEnv("DB_HOST", "localhost"),
-		getEnv("DB_PORT", "5432"),
-		getEnv("DB_USER", "postgres"),
-		getEnv("DB_PASSWORD", ""),
-		getEnv("DB_NAME", "postgres"),
-	)
+// Handle API requests to delete a record by CID. The row is kept with
+// deleted_at set, so it can be restored later.
+func (s *Server) deleteRecordHandler(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimSpace(r.PathValue("cid"))
+	if cid == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_cid", "CID is required")
+		return
+	}
 
-	for i := 0; i < 5; i++ { // Retry up to 5 times
-		db, err = sql.Open("postgres", connStr)
-		if err == nil {
-			if pingErr := db.Ping(); pingErr == nil {
-				log.Println("Database connection established.")
-				break
-			} else {
-				log.Printf("Database ping failed (attempt %d/5): %v. Retrying in 2 seconds...", i+1, pingErr)
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	start := time.Now()
+	result, err := s.db.ExecContext(ctx, `UPDATE `+s.tableName+` SET deleted_at = now() WHERE cid = $1 AND `+notDeleted, cid)
+	s.logSlowQuery(ctx, "delete_record", start)
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error deleting record %s: %v", cid, err)
+		s.respondDBError(w, err, "Unable to delete record")
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error reading affected rows for %s: %v", cid, err)
+		s.respondDBError(w, err, "Unable to delete record")
+		return
+	}
+	if n == 0 {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logInfofCtx(r.Context(), "Record %s deleted.", cid)
+}
+
+// Handle API requests to restore a soft-deleted record by CID
+func (s *Server) restoreRecordHandler(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimSpace(r.PathValue("cid"))
+	if cid == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_cid", "CID is required")
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	var record Record
+	start := time.Now()
+	err := scanRecord(s.db.QueryRowContext(ctx, `
+        UPDATE `+s.tableName+` SET deleted_at = NULL, updated_at = now()
+        WHERE cid = $1 AND deleted_at IS NOT NULL RETURNING `+recordColumns, cid), &record)
+	s.logSlowQuery(ctx, "restore_record", start)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not_found", "No deleted record with this CID")
+		return
+	}
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error restoring record %s: %v", cid, err)
+		s.respondDBError(w, err, "Unable to restore record")
+		return
+	}
+
+	record.Image.String = s.resolveImageURL(record.Image.String)
+	writeJSON(w, http.StatusOK, record)
+	logInfofCtx(r.Context(), "Record %s restored.", cid)
+}
+
+// Fields of a record that PATCH may change
+var patchableFields = []string{"name", "image"}
+
+// Handle API requests to partially update a record by CID. Only the fields
+// present in the body change; an explicit null image clears it, while name
+// can't be null.
+func (s *Server) patchRecordHandler(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimSpace(r.PathValue("cid"))
+	if cid == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_cid", "CID is required")
+		return
+	}
+
+	// Decode into raw values so an omitted field can be told apart from null
+	var body map[string]json.RawMessage
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+	if !decodeJSONBody(w, r, &body, "Malformed JSON body") {
+		return
+	}
+	for field := range body {
+		if !slices.Contains(patchableFields, field) {
+			writeJSON(w, http.StatusBadRequest, errorResponse{
+				Error: fmt.Sprintf("Field %q can't be patched", field),
+				Code:  "unknown_field",
+				Field: field,
+			})
+			return
+		}
+	}
+	if len(body) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "empty_patch", "At least one of name or image is required")
+		return
+	}
+
+	var sets []string
+	var args []interface{}
+	for _, field := range patchableFields {
+		raw, ok := body[field]
+		if !ok {
+			continue
+		}
+		value, err := patchValue(field, raw)
+		if err != nil {
+			var fieldErr *FieldError
+			if errors.As(err, &fieldErr) {
+				writeJSON(w, http.StatusUnprocessableEntity, errorResponse{
+					Error: fieldErr.Message,
+					Code:  "validation_failed",
+					Field: fieldErr.Field,
+				})
+				return
 			}
-		} else {
-			log.Printf("Database connection failed (attempt %d/5): %v. Retrying in 2 seconds...", i+1, err)
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error(), Code: "invalid_type", Field: field})
+			return
 		}
-		time.Sleep(2 * time.Second)
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", field, len(args)))
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	var record Record
+	query := fmt.Sprintf(`UPDATE %s SET %s, updated_at = now() WHERE cid = $%d AND %s RETURNING %s`,
+		s.tableName, strings.Join(sets, ", "), len(args)+1, notDeleted, recordColumns)
+	start := time.Now()
+	err := scanRecord(s.db.QueryRowContext(ctx, query, append(args, cid)...), &record)
+	s.logSlowQuery(ctx, "patch_record", start)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
 	}
 	if err != nil {
-		log.Fatalf("Unable to connect to the database after retries: %v", err)
+		logErrorfCtx(r.Context(), "Error patching record %s: %v", cid, err)
+		s.respondDBError(w, err, "Unable to update record")
+		return
 	}
 
-	// Ensure table exists
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS records (
-            id SERIAL PRIMARY KEY,
-            cid TEXT UNIQUE, 
-            name TEXT NOT NULL, 
-            image TEXT
-        )`)
-	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
+	record.Image.String = s.resolveImageURL(record.Image.String)
+	writeJSON(w, http.StatusOK, record)
+	logDebugfCtx(r.Context(), "Record %s patched successfully.", cid)
+}
+
+// Decode and validate the new value of a patched field. A null or empty
+// image is stored as NULL.
+func patchValue(field string, raw json.RawMessage) (interface{}, error) {
+	if string(raw) == "null" {
+		if field == "name" {
+			return nil, &FieldError{"name", "name can't be null"}
+		}
+		return NullString{}, nil
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("%s must be a string", field)
+	}
+	switch field {
+	case "name":
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return nil, &FieldError{"name", "name is required"}
+		}
+		if err := checkFieldLengths(value, ""); err != nil {
+			return nil, err
+		}
+	case "image":
+		if err := checkFieldLengths("", value); err != nil {
+			return nil, err
+		}
+		return newNullString(value), nil
 	}
-	log.Println("Database table initialized successfully.")
+	return value, nil
 }
 
-// Load CSV data and insert it into the database
-func loadCSVAndInsertData(filePath string) {
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		log.Printf("CSV file not found: %s. Skipping data insertion.", filePath)
+// Handle API requests to update a record's name and image by CID.
+// An omitted image leaves the stored value intact; send "" to clear it to NULL.
+func (s *Server) updateRecordHandler(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimSpace(r.PathValue("cid"))
+	if cid == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_cid", "CID is required")
 		return
 	}
 
-	file, err := os.Open(filePath)
+	var body RecordUpdate
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+	if !decodeJSONBody(w, r, &body, "Malformed JSON body") {
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_name", "name is required")
+		return
+	}
+	image := ""
+	if body.Image != nil {
+		image = *body.Image
+	}
+	var fieldErr *FieldError
+	if errors.As(checkFieldLengths(body.Name, image), &fieldErr) {
+		writeJSON(w, http.StatusUnprocessableEntity, errorResponse{Error: fieldErr.Message, Code: "validation_failed", Field: fieldErr.Field})
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	var record Record
+	start := time.Now()
+	err := scanRecord(s.db.QueryRowContext(ctx, `
+        UPDATE `+s.tableName+` SET name = $1, image = NULLIF(COALESCE($2, image), ''), updated_at = now()
+        WHERE cid = $3 AND `+notDeleted+` RETURNING `+recordColumns,
+		body.Name, body.Image, cid), &record)
+	s.logSlowQuery(ctx, "put_record", start)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Record not found")
+		return
+	}
+	if err != nil {
+		logErrorfCtx(r.Context(), "Error updating record %s: %v", cid, err)
+		s.respondDBError(w, err, "Unable to update record")
+		return
+	}
+
+	record.Image.String = s.resolveImageURL(record.Image.String)
+	writeJSON(w, http.StatusOK, record)
+	logDebugfCtx(r.Context(), "Record %s updated successfully.", cid)
+}
+
+// Handle CSV uploads sent as multipart/form-data in the "file" field and
+// import them into the database
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	// Importing a large file can take longer than HTTP_WRITE_TIMEOUT allows
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	file, header, err := r.FormFile("file")
 	if err != nil {
-		log.Fatalf("Unable to open CSV file: %v", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "Uploaded file is too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "missing_file", "A CSV file is required in the \"file\" form field")
+		return
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	mediaType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if !csvContentTypes[mediaType] {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Uploaded file must be a CSV")
+		return
+	}
+
+	summary, err := s.importCSV(r.Context(), file, header.Filename)
 	if err != nil {
-		log.Fatalf("Unable to read CSV file: %v", err)
+		logErrorfCtx(r.Context(), "Error importing uploaded CSV %s: %v", header.Filename, err)
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_csv", "Uploaded file is not valid CSV")
+			return
+		}
+		var csvErr *CSVError
+		if errors.As(err, &csvErr) {
+			writeJSONError(w, http.StatusUnprocessableEntity, csvErr.Code, csvErr.Message)
+			return
+		}
+		s.respondDBError(w, err, "Unable to import CSV")
+		return
 	}
 
-	for i, record := range records {
-		if len(record) < 3 { // Ensure all required fields are present
-			log.Printf("Skipping invalid record at line %d: %v", i+1, record)
-			continue
+	writeJSON(w, http.StatusOK, summary)
+	logDebugfCtx(r.Context(), "Uploaded CSV %s imported successfully.", header.Filename)
+}
+
+// Import the configured CSV_PATH, waiting for an import already in progress
+func (s *Server) importConfiguredCSV(ctx context.Context) (ImportSummary, error) {
+	s.importMu.Lock()
+	defer s.importMu.Unlock()
+	return s.loadCSVAndInsertData(ctx, s.csvPath)
+}
+
+// Handle admin requests to rerun the CSV_PATH import and report its summary.
+// Only one import runs at a time; others are refused with 409. The import
+// runs to completion even if the client disconnects first.
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.importMu.TryLock() {
+		writeJSONError(w, http.StatusConflict, "import_in_progress", "A CSV import is already running")
+		return
+	}
+	defer s.importMu.Unlock()
+	// Large imports may outlive HTTP_WRITE_TIMEOUT, which would drop the summary
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	logInfofCtx(r.Context(), "Reloading CSV data from %s.", s.csvPath)
+	summary, err := s.loadCSVAndInsertData(context.WithoutCancel(r.Context()), s.csvPath)
+	if err != nil {
+		logErrorfCtx(r.Context(), "CSV reload from %s failed: %v", s.csvPath, err)
+		s.respondDBError(w, err, "Unable to import CSV")
+		return
+	}
+
+	logEvent("csv_reload_complete", "CSV reload complete.", "source", s.csvPath,
+		"inserted", summary.Inserted, "skipped", summary.Skipped, "conflicted", summary.Conflicted,
+		"errored", summary.Errored, "duplicates", summary.Duplicates, "failed_batches", summary.FailedBatches, "dry_run", summary.DryRun)
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// Handle liveness checks by pinging the database. Successful checks are not
+// logged to keep probe traffic out of the logs.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		logWarnfCtx(r.Context(), "Health check failed: %v", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Connection pool statistics returned by /stats
+type poolStats struct {
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDuration       string `json:"wait_duration"`
+	MaxIdleClosed      int64  `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+}
+
+// Handle API requests for a snapshot of the database connection pool
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.db.Stats()
+	writeJSON(w, http.StatusOK, poolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.String(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	})
+}
+
+// Handle readiness checks, reporting 503 until the schema is initialized
+// and the initial CSV import has finished
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]bool{
+		"schema":     s.schemaReady.Load(),
+		"csv_import": s.csvLoaded.Load(),
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, passed := range checks {
+		if !passed {
+			status, code = "not_ready", http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks, "read_only": s.readOnly.Load()})
+}
+
+// Handle admin requests to switch read-only mode on or off at runtime with a
+// {"read_only": true|false} body
+func (s *Server) readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ReadOnly *bool `json:"read_only"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+	if !decodeJSONBody(w, r, &body, "Malformed JSON body") {
+		return
+	}
+	if body.ReadOnly == nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "read_only is required", Code: "bad_request", Field: "read_only"})
+		return
+	}
+
+	if s.readOnly.Swap(*body.ReadOnly) != *body.ReadOnly {
+		if *body.ReadOnly {
+			logEvent("read_only_enabled", "Read-only mode enabled; writes are refused.")
+		} else {
+			logEvent("read_only_disabled", "Read-only mode disabled; writes are accepted again.")
 		}
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"read_only": *body.ReadOnly})
+}
 
-		_, err := db.Exec(`
-            INSERT INTO records (cid, name, image) 
-            VALUES ($1, $2, $3) ON CONFLICT (cid) DO NOTHING`,
-			record[0], record[1], record[2])
-		if err != nil {
-			log.Printf("Error inserting record (line %d): %v", i+1, err)
+// Report whether err means the database could not be reached, as opposed to
+// a query that failed
+func isDBUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &netErr)
+}
+
+// Report whether err is a violation of the unique index on name added by
+// UNIQUE_NAME, e.g. when an update renames a record to a name in use. Postgres
+// folds the unquoted index name to lower case, so a mixed-case DB_TABLE still
+// matches.
+func (s *Server) isDuplicateName(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && strings.EqualFold(pqErr.Constraint, s.tableName+"_name_key")
+}
+
+// Report whether err is a transient failure that a retry on a fresh
+// connection is likely to get past, such as a connection dropped during a
+// failover or a server shutting down
+func isTransientDBError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+			return true
 		}
+		return pqErr.Code.Class() == "08" // connection_exception
 	}
-	log.Println("CSV data inserted into the database successfully.")
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
 }
 
-// Handle API requests to fetch data
-func fetchDataHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(`SELECT cid, name, image FROM records`)
-	if err != nil {
-		log.Printf("Error fetching records: %v", err)
-		http.Error(w, "Unable to fetch records", http.StatusInternalServerError)
+// Run a read-only query, retrying it up to readQueryAttempts times in all
+// while it fails with a transient error. Only use it for reads: a write whose
+// connection dropped may have been applied anyway.
+func retryRead[T any](ctx context.Context, query func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := query()
+		if err == nil || attempt == readQueryAttempts || !isTransientDBError(err) {
+			return result, err
+		}
+		logWarnfCtx(ctx, "Transient database error (attempt %d/%d): %v. Retrying.", attempt, readQueryAttempts, err)
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(time.Duration(attempt) * readRetryDelay):
+		}
+	}
+}
+
+// Log a warning when the query called name, started at start, ran past the
+// SLOW_QUERY_MS threshold. For queries returning rows this covers the time
+// until the first row is available.
+func (s *Server) logSlowQuery(ctx context.Context, name string, start time.Time) {
+	if elapsed := time.Since(start); s.slowQueryThreshold > 0 && elapsed >= s.slowQueryThreshold {
+		logWarnfCtx(ctx, "Slow query %s took %s.", name, elapsed.Round(time.Millisecond))
+	}
+}
+
+// Respond to a failed database call without exposing driver details: 503 when
+// the database is unreachable, 500 with the given message otherwise. Callers
+// log the underlying error.
+func (s *Server) respondDBError(w http.ResponseWriter, err error, message string) {
+	if s.isDuplicateName(err) {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "Record with this name already exists", Code: "duplicate_name", Field: "name"})
 		return
 	}
-	defer rows.Close()
+	if isDBUnavailable(err) {
+		writeJSONError(w, http.StatusServiceUnavailable, "db_unavailable", "Database unavailable")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, "internal_error", message)
+}
 
-	var records []Record
-	for rows.Next() {
-		var record Record
-		if err := rows.Scan(&record.CID, &record.Name, &record.Image); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			http.Error(w, "Error reading data", http.StatusInternalServerError)
-			return
+// JSON error envelope returned by all handlers. Messages are generic and never
+// include driver or SQL details; those are only logged server-side.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	Field string `json:"field,omitempty"`
+}
+
+// Helper function to write an error envelope with the given status code
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorResponse{Error: message, Code: code})
+}
+
+// Decode a JSON request body into v, rejecting fields v doesn't declare,
+// values of the wrong type, and trailing data. On failure a 400 naming the
+// offending field, when known, is written and false is returned.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, message string) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	if err == nil {
+		return true
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "Request body is too large")
+	case errors.As(err, &typeErr):
+		// Field is empty for errors raised by custom unmarshalers like NullString
+		expected, _ := jsonSchema(typeErr.Type)["type"].(string)
+		message := fmt.Sprintf("Expected a %s, not %s", expected, typeErr.Value)
+		if typeErr.Field != "" {
+			message = fmt.Sprintf("%s must be of type %s, not %s", typeErr.Field, expected, typeErr.Value)
 		}
-		records = append(records, record)
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: message, Code: "invalid_type", Field: typeErr.Field})
+	case strings.HasPrefix(err.Error(), `json: unknown field "`):
+		// encoding/json has no typed error for unknown fields
+		field := strings.TrimSuffix(strings.TrimPrefix(err.Error(), `json: unknown field "`), `"`)
+		writeJSON(w, http.StatusBadRequest, errorResponse{
+			Error: fmt.Sprintf("Unknown field %q", field),
+			Code:  "unknown_field",
+			Field: field,
+		})
+	default:
+		writeJSONError(w, http.StatusBadRequest, "malformed_json", message)
 	}
+	return false
+}
 
+// Helper function to write a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(records); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErrorf("Error encoding response: %v", err)
 	}
-	log.Println("Data fetched and returned successfully.")
 }
 
 // Helper function to get environment variables with a fallback
@@ -149,23 +2120,181 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// Helper function to get integer environment variables with a fallback
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		logWarnf("Invalid integer for %s: %q. Using default %d.", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Helper function to get boolean environment variables (e.g. "true", "0") with a fallback
+func getEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logWarnf("Invalid boolean for %s: %q. Using default %t.", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+// Helper function to get duration environment variables (e.g. "5m") with a fallback
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logWarnf("Invalid duration for %s: %q. Using default %s.", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Open the listener for addr. A unix:/path/to.sock address listens on a Unix
+// domain socket, replacing a stale socket file left behind by an earlier run;
+// anything else is a TCP host:port.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		// Only remove the file when nothing is accepting connections on it
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket: %w", err)
+		}
+		log.Printf("Removed stale socket %s.", path)
+	}
+	return net.Listen("unix", path)
+}
+
 func main() {
 	loadEnv()
-	initDB()
+	csvPath := flag.String("csv", getEnv("CSV_PATH", "data.csv"), "path, directory, glob, or http(s) URL of the CSV data to import at startup, or - for stdin")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Tracing setup failed: %v", err)
+	}
+
+	srv := newServer()
+	srv.csvPath = *csvPath
+	connStr, err := srv.initDB()
+	if err != nil {
+		log.Fatalf("Database initialization failed: %v", err)
+	}
 	defer func() {
-		if err := db.Close(); err != nil {
-			log.Printf("Error closing database connection: %v", err)
+		if err := srv.db.Close(); err != nil {
+			logErrorf("Error closing database connection: %v", err)
 		}
 	}()
+	registerPoolMetrics(srv.db)
 
-	loadCSVAndInsertData("data.csv")
+	// Changes made by other instances or by hand also invalidate the cache
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	defer stopListening()
+	if srv.cacheNotify && srv.cache.ttl > 0 {
+		go srv.cache.listenForChanges(listenCtx, connStr, srv.tableName+"_changed")
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/data", http.StatusPermanentRedirect)
-	})
-	http.HandleFunc("/data", fetchDataHandler)
-	log.Println("Server started on port 8080")
-	if err := http.ListenAndServe("0.0.0.0:8080", nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	// Import in the background so /ready can report progress while it runs. A
+	// failed import leaves the API serving the rows already in the database
+	// unless FAIL_ON_CSV_ERROR asks for the previous fail-fast behavior.
+	failOnCSVError := getEnvBool("FAIL_ON_CSV_ERROR", false)
+	go func() {
+		summary, err := srv.importConfiguredCSV(context.Background())
+		if err != nil {
+			if failOnCSVError {
+				log.Fatalf("CSV import failed: %v", err)
+			}
+			logErrorf("CSV import failed: %v. Continuing with the existing data.", err)
+			return
+		}
+		logEvent("csv_import_complete", "Startup CSV import complete.", "source", *csvPath,
+			"inserted", summary.Inserted, "skipped", summary.Skipped, "conflicted", summary.Conflicted,
+			"errored", summary.Errored, "duplicates", summary.Duplicates, "failed_batches", summary.FailedBatches, "dry_run", summary.DryRun)
+	}()
+
+	// LISTEN_ADDR takes precedence over HOST and PORT, and may name a Unix
+	// socket as unix:/path/to.sock
+	addr := getEnv("LISTEN_ADDR", net.JoinHostPort(getEnv("HOST", "0.0.0.0"), getEnv("PORT", "8080")))
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen on %s: %v", addr, err)
+	}
+	server := &http.Server{
+		Handler:      srv.routes(),
+		ReadTimeout:  getEnvDuration("HTTP_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout: getEnvDuration("HTTP_WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:  getEnvDuration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+	}
+	// Serve HTTPS when both a certificate and key are configured
+	certFile, keyFile := getEnv("TLS_CERT_FILE", ""), getEnv("TLS_KEY_FILE", "")
+	useTLS := certFile != "" && keyFile != ""
+	if useTLS {
+		for _, path := range []string{certFile, keyFile} {
+			if _, err := os.Stat(path); err != nil {
+				log.Fatalf("TLS is misconfigured: %v", err)
+			}
+		}
+		log.Printf("TLS enabled with certificate %s.", certFile)
+	} else {
+		if certFile != "" || keyFile != "" {
+			logWarnf("Only one of TLS_CERT_FILE and TLS_KEY_FILE is set. Serving plain HTTP.")
+		}
+		log.Println("TLS disabled; serving plain HTTP.")
+	}
+
+	go func() {
+		logEvent("server_listening", fmt.Sprintf("Server %s started on %s", versionString(), addr),
+			"addr", addr, "version", version, "tls", useTLS)
+		var err error
+		if useTLS {
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	// Wait for an interrupt or termination signal, then drain in-flight requests
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("Received %s, shutting down server...", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logErrorf("Error during server shutdown: %v", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logErrorf("Error flushing traces: %v", err)
 	}
+	logEvent("server_shutdown", "Server stopped.", "signal", sig.String())
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Create a Server backed by a sqlmock connection
+func newMockServer(t *testing.T) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unable to open sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s := newServer()
+	s.db = db
+	s.schemaReady.Store(true)
+	return s, mock
+}
+
+// Serve GET /data from s and return the recorded response
+func getData(s *Server) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.fetchDataHandler(w, httptest.NewRequest(http.MethodGet, "/data", nil))
+	return w
+}
+
+func TestFetchDataReturnsRecords(t *testing.T) {
+	s, mock := newMockServer(t)
+	changed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT COUNT\(\*\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max", "last_change"}).AddRow(2, 7, changed))
+	mock.ExpectQuery(`SELECT `+recordColumns+` FROM records`).
+		WithArgs(defaultPageLimit, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"cid", "name", "image", "created_at", "updated_at", "metadata", "deleted_at"}).
+			AddRow("QmA", "first", "ipfs://QmA", changed, nil, nil, nil).
+			AddRow("QmB", "second", nil, changed, nil, `{"size":"L"}`, nil))
+
+	w := getData(s)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "2" {
+		t.Errorf("X-Total-Count = %q, want 2", got)
+	}
+	if vary := w.Header().Values("Vary"); !slices.Contains(vary, "Accept") {
+		t.Errorf("Vary = %q, want it to include Accept", vary)
+	}
+	if got := w.Header().Get("Last-Modified"); got != changed.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified = %q, want %q", got, changed.Format(http.TimeFormat))
+	}
+	var records []Record
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+		t.Fatalf("invalid JSON body %s: %v", w.Body, err)
+	}
+	if len(records) != 2 || records[0].CID != "QmA" || records[1].Name != "second" || records[1].Metadata["size"] != "L" {
+		t.Errorf("records = %+v", records)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFetchDataEmpty(t *testing.T) {
+	s, mock := newMockServer(t)
+	mock.ExpectQuery(`SELECT COUNT\(\*\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max", "last_change"}).AddRow(0, 0, nil))
+	mock.ExpectQuery(`SELECT ` + recordColumns + ` FROM records`).
+		WillReturnRows(sqlmock.NewRows([]string{"cid", "name", "image", "created_at", "updated_at", "metadata", "deleted_at"}))
+
+	w := getData(s)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Errorf("body = %q, want []", got)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "0" {
+		t.Errorf("X-Total-Count = %q, want 0", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFetchDataQueryError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"query failure", errors.New("relation does not exist"), http.StatusInternalServerError, "internal_error"},
+		{"database unreachable", syscall.ECONNREFUSED, http.StatusServiceUnavailable, "db_unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery(`SELECT COUNT\(\*\)`).WillReturnError(tt.err)
+
+			w := getData(s)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var body errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid JSON body %s: %v", w.Body, err)
+			}
+			if body.Code != tt.wantCode || body.Error == "" {
+				t.Errorf("body = %+v, want code %q", body, tt.wantCode)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Free-form record attributes stored in the metadata JSONB column. A nil or
+// empty map is stored as NULL, and NULL reads back as nil.
+type Metadata map[string]interface{}
+
+// Encode the metadata as JSON text for the database driver
+func (m Metadata) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Decode a JSONB value read from the database
+func (m *Metadata) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported metadata type %T", src)
+	}
+	return json.Unmarshal(data, m)
+}
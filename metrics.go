@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics exposed at /metrics
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests by route and status code.",
+	}, []string{"path", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path"})
+)
+
+// Export connection pool metrics for db. Call once per process, as the
+// collectors are registered globally.
+func registerPoolMetrics(db *sql.DB) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "db_open_connections",
+		Help: "Number of established connections to the database.",
+	}, func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+}
+
+// Record request counts and durations. The route pattern is used as the path
+// label so that path parameters like CIDs don't blow up label cardinality.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		path := r.Pattern
+		if path == "" {
+			path = "unmatched"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequestsTotal.WithLabelValues(path, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+// Probe endpoints left out of the access log to keep it readable
+var quietPaths = map[string]bool{
+	"/health": true,
+	"/ready":  true,
+}
+
+// Paths served without touching the database
+var dbFreePaths = map[string]bool{
+	"/":                      true,
+	"/ready":                 true,
+	"/version":               true,
+	"/openapi.json":          true,
+	"/schema":                true,
+	"/metrics":               true,
+	"/admin/import/progress": true,
+	"/admin/read-only":       true,
+}
+
+// Answer 503 instead of panicking when the database connection was never set up
+func (s *Server) requireDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.db == nil && !dbFreePaths[r.URL.Path] {
+			writeJSONError(w, http.StatusServiceUnavailable, "db_unavailable", "Database unavailable")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Replaces the plain-text body ServeMux writes for unmatched requests with
+// the JSON error envelope. Headers the mux set, like Allow, are kept.
+type routingErrorWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (rw *routingErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		writeJSONError(rw.ResponseWriter, status, "not_found", "No route matches the requested path")
+	case http.StatusMethodNotAllowed:
+		writeJSONError(rw.ResponseWriter, status, "method_not_allowed", "Method not allowed")
+	default:
+		rw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	rw.replaced = true
+}
+
+func (rw *routingErrorWriter) Write(b []byte) (int, error) {
+	if rw.replaced {
+		return len(b), nil
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Answer requests that match no route with JSON 404 and 405 errors instead of
+// ServeMux's plain-text ones. The mux still decides which applies, including
+// the Allow header of a 405, and still serves its redirects unchanged.
+func jsonRoutingErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &routingErrorWriter{ResponseWriter: w}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Answer 503 to write requests while the server is in read-only mode. Admin
+// endpoints stay available, so the mode can be switched off again and
+// reloads still run, as do lookups, which only use POST to carry a body.
+func (s *Server) rejectWritesWhenReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			readOnlyExempt := strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasSuffix(r.URL.Path, "/data/lookup")
+			if s.readOnly.Load() && !readOnlyExempt {
+				writeJSONError(w, http.StatusServiceUnavailable, "read_only", "The API is in read-only mode for maintenance; writes are temporarily disabled")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wrap an http.ResponseWriter to capture the status code and bytes written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Let http.ResponseController reach the underlying writer, e.g. for flushing
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Longest client-supplied X-Request-ID that is passed through as is
+const maxRequestIDLength = 128
+
+// Tag each request with the client's X-Request-ID, or a new UUID when it sent
+// none or an unusable one, and echo the ID in the response. Log lines written
+// while serving the request carry it as request_id.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Report whether id is short and made of printable ASCII, so a client can't
+// inject control characters or huge values into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Turn a panicking handler into a 500 JSON error and log its stack trace,
+// instead of dropping the client's connection. When the handler already
+// started its response only the log entry is written. Aborted handlers are
+// left to net/http, which expects to see http.ErrAbortHandler.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logErrorfCtx(r.Context(), "Panic serving %s %s: %v\n%s", r.Method, r.URL.RequestURI(), err, debug.Stack())
+			if rec.status == 0 {
+				writeJSONError(rec, http.StatusInternalServerError, "internal_error", "Internal server error")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// Log method, path, status, bytes written, and duration for every request
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if quietPaths[r.URL.Path] {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logInfofCtx(r.Context(), "%s %s %d %dB %s", r.Method, r.URL.RequestURI(), rec.status, rec.bytes, time.Since(start).Round(time.Microsecond))
+	})
+}
+
+// Add CORS headers for browser clients and answer OPTIONS preflight requests
+// with 204. Allowed origins come from CORS_ALLOWED_ORIGINS as a comma-separated
+// list, defaulting to "*".
+func cors(next http.Handler) http.Handler {
+	allowAll := false
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(getEnv("CORS_ALLOWED_ORIGINS", "*"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			allowAll = true
+		} else if origin != "" {
+			allowed[origin] = true
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		switch {
+		case allowAll:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case allowed[origin]:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Idempotency-Key, X-Request-ID")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Require the API_KEY to be presented in the X-API-Key header or as an
+// "Authorization: Bearer <key>" header. When API_KEY is unset the handler is
+// left open for backward compatibility.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	apiKey := getEnv("API_KEY", "")
+	if apiKey == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Per-client limiters idle for longer than this are dropped
+const limiterIdleTimeout = 3 * time.Minute
+
+// Token bucket per client IP
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limit each client IP to RATE_LIMIT_RPS requests per second with bursts of up
+// to RATE_LIMIT_BURST (defaulting to the rate), answering 429 with Retry-After
+// once the bucket is empty. Probe endpoints are exempt, as are requests over
+// a Unix socket, which carry no client address and are expected to come from a
+// proxy doing its own limiting. A rate of 0, the default, disables limiting.
+func rateLimit(next http.Handler) http.Handler {
+	rps := getEnvInt("RATE_LIMIT_RPS", 0)
+	if rps <= 0 {
+		return next
+	}
+	burst := max(getEnvInt("RATE_LIMIT_BURST", rps), 1)
+
+	var mu sync.Mutex
+	clients := make(map[string]*clientLimiter)
+	go func() {
+		for range time.Tick(time.Minute) {
+			mu.Lock()
+			for ip, c := range clients {
+				if time.Since(c.lastSeen) > limiterIdleTimeout {
+					delete(clients, ip)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if quietPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Every connection on a Unix socket has the same RemoteAddr, so they
+		// would all share one bucket
+		if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		mu.Lock()
+		c, ok := clients[ip]
+		if !ok {
+			c = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+			clients[ip] = c
+		}
+		c.lastSeen = time.Now()
+		mu.Unlock()
+
+		reservation := c.limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel() // Give the token back, this request isn't served
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Responses smaller than this are sent uncompressed
+const gzipMinSize = 1024
+
+// Buffer the start of a response and switch to gzip once it grows past
+// gzipMinSize, so tiny responses are not compressed
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+	plain  bool // Set once the response is committed uncompressed
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(b)
+	case g.plain:
+		return g.ResponseWriter.Write(b)
+	}
+
+	g.buf.Write(b)
+	if g.buf.Len() < gzipMinSize {
+		return len(b), nil
+	}
+	if err := g.start(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Commit the headers and flush the buffered bytes, compressed unless the
+// handler already set its own Content-Encoding
+func (g *gzipResponseWriter) start() error {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" {
+		g.plain = true
+		g.ResponseWriter.WriteHeader(g.status)
+		_, err := g.ResponseWriter.Write(g.buf.Bytes())
+		return err
+	}
+
+	if h.Get("Content-Type") == "" {
+		// Sniff from the uncompressed bytes, not the gzip stream
+		h.Set("Content-Type", http.DetectContentType(g.buf.Bytes()))
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf.Bytes())
+	return err
+}
+
+// Finish the response, writing small bodies uncompressed
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	if g.plain {
+		return nil
+	}
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	_, err := g.ResponseWriter.Write(g.buf.Bytes())
+	return err
+}
+
+// Send everything written so far to the client, compressing the buffered
+// start of the response first, so streamed responses aren't held back
+func (g *gzipResponseWriter) FlushError() error {
+	if g.gz == nil && !g.plain {
+		if g.status == 0 {
+			g.status = http.StatusOK
+		}
+		if err := g.start(); err != nil {
+			return err
+		}
+	}
+	if g.gz != nil {
+		if err := g.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Compress responses with gzip for clients that advertise support for it
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer func() {
+			if err := gw.Close(); err != nil {
+				logErrorfCtx(r.Context(), "Error finishing gzip response: %v", err)
+			}
+		}()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// Report whether the Accept-Encoding header lists gzip with a non-zero quality
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		return strings.ReplaceAll(params, " ", "") != "q=0"
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Upper bound for applying all pending migrations at startup
+const migrationTimeout = 5 * time.Minute
+
+// A versioned schema change. In Statement, {{table}} is replaced with the
+// configured table name. A migration with an Enabled func is only applied,
+// and recorded, once it returns true, so opting in later still applies it.
+type migration struct {
+	Version     int
+	Description string
+	Statement   string
+	Enabled     func(s *Server) bool
+}
+
+// Schema migrations in the order they are applied. Released migrations must
+// not be edited; add a new version at the end instead. The early statements
+// use IF NOT EXISTS so tables created before migrations were tracked are
+// adopted without changes.
+var migrations = []migration{
+	{1, "create records table", `
+        CREATE TABLE IF NOT EXISTS {{table}} (
+            id SERIAL PRIMARY KEY,
+            cid TEXT UNIQUE,
+            name TEXT NOT NULL,
+            image TEXT
+        )`, nil},
+	{2, "add created_at and updated_at", `
+        ALTER TABLE {{table}}
+            ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ DEFAULT now(),
+            ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`, nil},
+	{3, "add metadata", `
+        ALTER TABLE {{table}} ADD COLUMN IF NOT EXISTS metadata JSONB`, nil},
+	{4, "store empty images as NULL", `
+        UPDATE {{table}} SET image = NULL WHERE image = ''`, nil},
+	{5, "add deleted_at for soft deletes", `
+        ALTER TABLE {{table}} ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`, nil},
+	{6, "unique names", `
+        CREATE UNIQUE INDEX IF NOT EXISTS {{table}}_name_key ON {{table}} (name)`,
+		func(s *Server) bool { return s.uniqueNames }},
+	{7, "index name", `
+        CREATE INDEX IF NOT EXISTS {{table}}_name_idx ON {{table}} (name)`, nil},
+	{8, "trigram index on name", `
+        CREATE EXTENSION IF NOT EXISTS pg_trgm;
+        CREATE INDEX IF NOT EXISTS {{table}}_name_trgm_idx ON {{table}} USING gin (name gin_trgm_ops)`,
+		func(s *Server) bool { return s.nameTrigramIndex }},
+	{9, "notify on changes", `
+        CREATE OR REPLACE FUNCTION {{table}}_notify_change() RETURNS trigger AS $$
+        BEGIN
+            PERFORM pg_notify('{{table}}_changed', TG_OP);
+            RETURN NULL;
+        END
+        $$ LANGUAGE plpgsql;
+        DROP TRIGGER IF EXISTS {{table}}_notify_change ON {{table}};
+        CREATE TRIGGER {{table}}_notify_change
+            AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON {{table}}
+            FOR EACH STATEMENT EXECUTE PROCEDURE {{table}}_notify_change()`,
+		func(s *Server) bool { return s.cacheNotify }},
+}
+
+// Apply pending migrations for the configured table in a single transaction.
+// Applied versions are tracked per table in schema_migrations, and an advisory
+// lock keeps instances starting at the same time from racing each other.
+func (s *Server) applyMigrations() error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            table_name TEXT NOT NULL,
+            version INT NOT NULL,
+            applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (table_name, version)
+        )`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to begin migration transaction: %w", err)
+	}
+	defer tx.Rollback() // No-op once the transaction has been committed
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('schema_migrations:' || $1))`, s.tableName); err != nil {
+		return fmt.Errorf("unable to acquire migration lock: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT version FROM schema_migrations WHERE table_name = $1`, s.tableName)
+	if err != nil {
+		return fmt.Errorf("unable to read applied migrations: %w", err)
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to read applied migrations: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to read applied migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] || (m.Enabled != nil && !m.Enabled(s)) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, strings.ReplaceAll(m.Statement, "{{table}}", s.tableName)); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (table_name, version) VALUES ($1, $2)`,
+			s.tableName, m.Version); err != nil {
+			return fmt.Errorf("unable to record migration %d: %w", m.Version, err)
+		}
+		log.Printf("Applied migration %d: %s.", m.Version, m.Description)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit migrations: %w", err)
+	}
+	return nil
+}
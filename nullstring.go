@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// A nullable text column, such as a record's image. It is NULL in the database
+// and null in JSON when absent, and an empty string is treated as absent.
+type NullString struct {
+	sql.NullString
+}
+
+// Wrap s, mapping the empty string to NULL
+func newNullString(s string) NullString {
+	return NullString{sql.NullString{String: s, Valid: s != ""}}
+}
+
+// Encode the value as a JSON string, or null when absent
+func (s NullString) MarshalJSON() ([]byte, error) {
+	if !s.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(s.String)
+}
+
+// Decode a JSON string or null, mapping "" to absent
+func (s *NullString) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = NullString{}
+		return nil
+	}
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = newNullString(v)
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Minimal OpenAPI 3 document types, covering only what this API describes
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody               `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Schema      interface{} `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                   `json:"required,omitempty"`
+	Content  map[string]interface{} `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                 `json:"description"`
+	Content     map[string]interface{} `json:"content,omitempty"`
+}
+
+// Reference a schema under components/schemas
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// Media type object for a JSON body with the given schema
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func arrayOf(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": schema}
+}
+
+// Derive a JSON schema from a Go type using its json struct tags, so the
+// documented shapes follow the types the handlers actually encode
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(NullString{}):
+		return map[string]interface{}{"type": "string", "nullable": true}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := jsonSchema(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return arrayOf(jsonSchema(t.Elem()))
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": true}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchema(field.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// Build the OpenAPI document for the /data family of endpoints, with paths
+// relative to the configured API prefix
+func (s *Server) openAPISpec() map[string]interface{} {
+	errorResponses := func(codes ...string) map[string]openAPIResponse {
+		descriptions := map[string]string{
+			"400": "Invalid request",
+			"401": "Missing or invalid API key",
+			"404": "Record not found",
+			"409": "A record with this CID, or with UNIQUE_NAME this name, already exists",
+			"413": "Request too large",
+			"415": "Unsupported media type",
+			"422": "Validation failed",
+			"500": "Internal error",
+			"503": "Database unavailable",
+		}
+		responses := make(map[string]openAPIResponse)
+		for _, code := range append(codes, "401", "500", "503") {
+			responses[code] = openAPIResponse{Description: descriptions[code], Content: jsonContent(schemaRef("Error"))}
+		}
+		return responses
+	}
+	withResponse := func(responses map[string]openAPIResponse, code string, response openAPIResponse) map[string]openAPIResponse {
+		responses[code] = response
+		return responses
+	}
+
+	cidParam := openAPIParameter{Name: "cid", In: "path", Required: true, Schema: map[string]string{"type": "string"}}
+	includeDeletedParam := openAPIParameter{Name: "include_deleted", In: "query", Description: "Also return soft-deleted records", Schema: map[string]interface{}{"type": "boolean", "default": false}}
+	filterParams := []openAPIParameter{
+		{Name: "name", In: "query", Description: "Case-insensitive substring match on name", Schema: map[string]string{"type": "string"}},
+		{Name: "has_image", In: "query", Description: "Only records with (true) or without (false) an image", Schema: map[string]string{"type": "boolean"}},
+		includeDeletedParam,
+	}
+	listParams := append([]openAPIParameter{
+		{Name: "limit", In: "query", Description: "Page size, capped at the server maximum", Schema: map[string]interface{}{"type": "integer", "default": defaultPageLimit, "maximum": maxPageLimit}},
+		{Name: "offset", In: "query", Schema: map[string]interface{}{"type": "integer", "default": 0}},
+		{Name: "sort", In: "query", Description: "cid or name, prefixed with - for descending", Schema: map[string]string{"type": "string"}},
+		{Name: "format", In: "query", Description: "Set to ndjson for newline-delimited JSON", Schema: map[string]interface{}{"type": "string", "enum": []string{"json", "ndjson"}}},
+		{Name: "shape", In: "query", Description: "Set to map for an object keyed by CID instead of an array", Schema: map[string]interface{}{"type": "string", "enum": []string{"array", "map"}}},
+	}, filterParams...)
+	cidsBody := &openAPIBody{Required: true, Content: jsonContent(map[string]interface{}{
+		"type":       "object",
+		"required":   []string{"cids"},
+		"properties": map[string]interface{}{"cids": arrayOf(map[string]string{"type": "string"})},
+	})}
+	recordBody := &openAPIBody{Required: true, Content: jsonContent(schemaRef("RecordInput"))}
+	recordResponse := openAPIResponse{Description: "The record", Content: jsonContent(schemaRef("Record"))}
+
+	paths := map[string]map[string]openAPIOperation{
+		"/data": {
+			"get": {
+				Summary:    "List records, as JSON, NDJSON, or CSV depending on format and Accept",
+				Parameters: listParams,
+				Responses: withResponse(errorResponses("400"), "200", openAPIResponse{
+					Description: "A page of records; X-Total-Count holds the number of matches. With RESPONSE_ENVELOPE set, JSON pages are wrapped as {data, meta}.",
+					Content: map[string]interface{}{
+						"application/json":     map[string]interface{}{"schema": arrayOf(schemaRef("Record"))},
+						"application/x-ndjson": map[string]interface{}{"schema": schemaRef("Record")},
+						"text/csv":             map[string]interface{}{"schema": map[string]string{"type": "string"}},
+					},
+				}),
+			},
+			"head": {
+				Summary:    "Return the headers of the matching GET without a body",
+				Parameters: listParams,
+				Responses:  map[string]openAPIResponse{"200": {Description: "Headers only"}},
+			},
+			"post": {
+				Summary:     "Create a record",
+				RequestBody: recordBody,
+				Responses:   withResponse(errorResponses("400", "409", "413", "422"), "201", recordResponse),
+			},
+		},
+		"/data/bulk": {
+			"post": {
+				Summary:     "Create many records in a single transaction",
+				RequestBody: &openAPIBody{Required: true, Content: jsonContent(arrayOf(schemaRef("RecordInput")))},
+				Responses: withResponse(errorResponses("400", "413"), "200", openAPIResponse{
+					Description: "Per-record outcome", Content: jsonContent(arrayOf(schemaRef("BulkInsertResult"))),
+				}),
+			},
+			"delete": {
+				Summary:     "Soft-delete the records matching a list of CIDs",
+				RequestBody: cidsBody,
+				Responses: withResponse(errorResponses("400", "413"), "200", openAPIResponse{
+					Description: "Number of records deleted",
+					Content: jsonContent(map[string]interface{}{
+						"type": "object", "properties": map[string]interface{}{"deleted": map[string]string{"type": "integer"}},
+					}),
+				}),
+			},
+		},
+		"/data/lookup": {
+			"post": {
+				Summary:     "Fetch the records matching a list of CIDs",
+				RequestBody: cidsBody,
+				Responses: withResponse(errorResponses("400", "413"), "200", openAPIResponse{
+					Description: "Found records and the CIDs that were not found",
+					Content: jsonContent(map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"records":   arrayOf(schemaRef("Record")),
+							"not_found": arrayOf(map[string]string{"type": "string"}),
+						},
+					}),
+				}),
+			},
+		},
+		"/data/{cid}": {
+			"get": {
+				Summary:    "Fetch a record by CID",
+				Parameters: []openAPIParameter{cidParam, includeDeletedParam},
+				Responses:  withResponse(errorResponses("400", "404"), "200", recordResponse),
+			},
+			"put": {
+				Summary:     "Replace a record's name and image; an omitted image is kept",
+				Parameters:  []openAPIParameter{cidParam},
+				RequestBody: &openAPIBody{Required: true, Content: jsonContent(schemaRef("RecordUpdate"))},
+				Responses:   withResponse(errorResponses("400", "404", "413", "422"), "200", recordResponse),
+			},
+			"patch": {
+				Summary:    "Change only the supplied fields; a null image clears it",
+				Parameters: []openAPIParameter{cidParam},
+				RequestBody: &openAPIBody{Required: true, Content: jsonContent(map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name":  map[string]string{"type": "string"},
+						"image": map[string]interface{}{"type": "string", "nullable": true},
+					},
+				})},
+				Responses: withResponse(errorResponses("400", "404", "413", "422"), "200", recordResponse),
+			},
+			"delete": {
+				Summary:    "Soft-delete a record by CID; it can be restored later",
+				Parameters: []openAPIParameter{cidParam},
+				Responses:  withResponse(errorResponses("400", "404"), "204", openAPIResponse{Description: "Deleted"}),
+			},
+		},
+		"/data/{cid}/restore": {
+			"post": {
+				Summary:    "Restore a soft-deleted record",
+				Parameters: []openAPIParameter{cidParam},
+				Responses:  withResponse(errorResponses("400", "404"), "200", recordResponse),
+			},
+		},
+		"/data.csv": {
+			"get": {
+				Summary: "Export all records as CSV",
+				Responses: withResponse(errorResponses(), "200", openAPIResponse{
+					Description: "CSV with cid, name, and image columns",
+					Content:     map[string]interface{}{"text/csv": map[string]interface{}{"schema": map[string]string{"type": "string"}}},
+				}),
+			},
+		},
+		"/count": {
+			"get": {
+				Summary:    "Count the records matching the filter",
+				Parameters: filterParams,
+				Responses: withResponse(errorResponses(), "200", openAPIResponse{
+					Description: "Number of matching records",
+					Content: jsonContent(map[string]interface{}{
+						"type": "object", "properties": map[string]interface{}{"count": map[string]string{"type": "integer"}},
+					}),
+				}),
+			},
+		},
+		"/data/random": {
+			"get": {
+				Summary: "Return a random sample of records",
+				Parameters: []openAPIParameter{
+					{Name: "count", In: "query", Description: "Number of records, capped at RANDOM_MAX_COUNT", Schema: map[string]interface{}{"type": "integer", "default": s.randomCount, "maximum": s.maxRandomCount}},
+				},
+				Responses: withResponse(errorResponses(), "200", openAPIResponse{
+					Description: "Randomly chosen records", Content: jsonContent(arrayOf(schemaRef("Record"))),
+				}),
+			},
+		},
+		"/upload": {
+			"post": {
+				Summary: "Import a CSV file sent in the file form field",
+				RequestBody: &openAPIBody{Required: true, Content: map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{"schema": map[string]interface{}{
+						"type":       "object",
+						"properties": map[string]interface{}{"file": map[string]string{"type": "string", "format": "binary"}},
+					}},
+				}},
+				Responses: withResponse(errorResponses("400", "413", "415", "422"), "200", openAPIResponse{
+					Description: "Import summary", Content: jsonContent(schemaRef("ImportSummary")),
+				}),
+			},
+		},
+	}
+
+	serverURL := s.apiPrefix
+	if serverURL == "" {
+		serverURL = "/"
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "Records API", "version": version},
+		"servers": []map[string]string{{"url": serverURL}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Record":           jsonSchema(reflect.TypeOf(Record{})),
+				"RecordInput":      jsonSchema(reflect.TypeOf(RecordInput{})),
+				"RecordUpdate":     jsonSchema(reflect.TypeOf(RecordUpdate{})),
+				"BulkInsertResult": jsonSchema(reflect.TypeOf(BulkInsertResult{})),
+				"ImportSummary":    jsonSchema(reflect.TypeOf(ImportSummary{})),
+				"Error":            jsonSchema(reflect.TypeOf(errorResponse{})),
+			},
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// Handle requests for the OpenAPI document describing the API
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.openAPISpec())
+}
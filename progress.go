@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often /admin/import/progress sends an update
+const progressInterval = time.Second
+
+// Progress of the most recent CSV import, as streamed by /admin/import/progress
+type importProgress struct {
+	Source     string    `json:"source"`
+	Running    bool      `json:"running"`
+	Rows       int       `json:"rows"`                  // Rows read so far
+	Bytes      int64     `json:"bytes"`                 // Input bytes read so far
+	TotalBytes int64     `json:"total_bytes,omitempty"` // Size of the input, when known
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// Latest import progress, shared between the import and the progress stream
+type progressTracker struct {
+	mu       sync.Mutex
+	progress importProgress
+	bytes    *countingReader
+}
+
+// Record the start of an import reading from input
+func (t *progressTracker) start(source string, input *countingReader, totalBytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress = importProgress{Source: source, Running: true, TotalBytes: totalBytes, StartedAt: time.Now()}
+	t.bytes = input
+}
+
+// Update the number of rows read so far
+func (t *progressTracker) setRows(rows int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Rows = rows
+}
+
+// Mark the import as finished; the final counts stay visible
+func (t *progressTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Running = false
+}
+
+// Return a copy of the current progress
+func (t *progressTracker) snapshot() importProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.progress
+	if t.bytes != nil {
+		p.Bytes = t.bytes.n.Load()
+	}
+	return p
+}
+
+// Count the bytes read through an io.Reader
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Size of r when it is a regular file, or 0 when unknown
+func inputSize(r io.Reader) int64 {
+	f, ok := r.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return 0
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// Format a progress log line, with a percentage when the input size is known
+func (p importProgress) String() string {
+	if p.TotalBytes > 0 {
+		return fmt.Sprintf("Read %d rows from %s (%d%% of %d bytes).", p.Rows, p.Source, p.Bytes*100/p.TotalBytes, p.TotalBytes)
+	}
+	return fmt.Sprintf("Read %d rows from %s.", p.Rows, p.Source)
+}
+
+// Handle admin requests to follow the current CSV import as Server-Sent
+// Events. A progress event is sent every second until the import finishes or
+// the client goes away; when no import is running a single event is sent.
+func (s *Server) importProgressHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{}) // The stream may outlive HTTP_WRITE_TIMEOUT
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		progress := s.progress.snapshot()
+		b, err := json.Marshal(progress)
+		if err != nil {
+			logErrorfCtx(r.Context(), "Error encoding import progress: %v", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if !progress.Running {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
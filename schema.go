@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Validation rules of the Record fields enforced by Record.validate, keyed by
+// JSON name
+var recordFieldRules = map[string]struct {
+	required  bool
+	maxLength int
+}{
+	"cid":   {required: true, maxLength: maxCIDLength},
+	"name":  {required: true, maxLength: maxNameLength},
+	"image": {maxLength: maxImageLength},
+}
+
+// Description of a single Record field returned by /schema
+type schemaField struct {
+	Name      string `json:"name"`
+	JSON      string `json:"json"`
+	Type      string `json:"type"`
+	Nullable  bool   `json:"nullable"`
+	Required  bool   `json:"required"`
+	MaxLength int    `json:"max_length,omitempty"`
+}
+
+// Describe the fields of a struct type from its json tags and the validation
+// rules, so new fields show up without touching this code
+func describeFields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := jsonSchema(field.Type)
+		typ, _ := schema["type"].(string)
+		if format, ok := schema["format"].(string); ok {
+			typ = format
+		}
+		nullable, _ := schema["nullable"].(bool)
+		rules := recordFieldRules[name]
+		fields = append(fields, schemaField{
+			Name:      field.Name,
+			JSON:      name,
+			Type:      typ,
+			Nullable:  nullable,
+			Required:  rules.required,
+			MaxLength: rules.maxLength,
+		})
+	}
+	return fields
+}
+
+// Handle requests for a description of the Record model
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":   "Record",
+		"fields": describeFields(reflect.TypeOf(Record{})),
+	})
+}
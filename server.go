@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Versioned mount point for the API, served alongside API_PREFIX
+const apiV1Prefix = "/api/v1"
+
+// Server holds the database handle and configuration shared by the HTTP
+// handlers
+type Server struct {
+	db           *sql.DB
+	queryTimeout time.Duration // Upper bound for individual queries, set from DB_QUERY_TIMEOUT
+
+	// Name of the table holding the records, set from DB_TABLE. It is
+	// interpolated into SQL, so initDB validates it against identifierPattern.
+	tableName string
+
+	cache         *responseCache
+	idempotency   *idempotencyStore
+	apiPrefix     string
+	enablePprof   bool
+	maxResultRows int // Upper bound on rows returned by /data; zero disables it
+
+	// What / serves: "redirect" to the records listing, or "index"
+	rootBehavior string
+
+	// How CSV imports treat existing CIDs, set from IMPORT_MODE: "skip" (the
+	// default) keeps existing rows, "upsert" overwrites them
+	importMode string
+
+	// Number of records /data/random returns by default and at most
+	randomCount    int
+	maxRandomCount int
+
+	// Wrap /data JSON responses as {"data": [...], "meta": {...}}
+	responseEnvelope bool
+
+	// Queries running longer than this are logged as slow, set from
+	// SLOW_QUERY_MS. Zero disables the warning.
+	slowQueryThreshold time.Duration
+
+	// Names must be unique across records, set from UNIQUE_NAME. Enabling it
+	// adds a unique index on name, which fails while duplicates exist.
+	uniqueNames bool
+
+	// Give ?name= searches a pg_trgm index, set from NAME_TRIGRAM_INDEX. Off
+	// by default since it needs the extension to be available.
+	nameTrigramIndex bool
+
+	// Have a trigger announce changes to the table so every instance can
+	// invalidate its response cache, set from CACHE_NOTIFY
+	cacheNotify bool
+
+	// Check CID format on writes and imports. Off by default so existing
+	// non-IPFS datasets keep loading; set VALIDATE_CID=true to turn it on.
+	validateCIDs bool
+	ipfsGateway  string // Base URL image CIDs are rewritten to; empty leaves them as stored
+
+	csvPath  string     // Source of the startup import, rerun by /admin/reload
+	importMu sync.Mutex // Held while a csvPath import runs
+	progress progressTracker
+
+	schemaReady atomic.Bool
+	csvLoaded   atomic.Bool
+	readOnly    atomic.Bool // Writes are refused with 503 while set
+}
+
+// Create a Server, reading its configuration from the environment. The
+// database is attached by initDB, which needs the configuration to migrate it.
+func newServer() *Server {
+	apiPrefix := strings.TrimRight(getEnv("API_PREFIX", ""), "/")
+	if apiPrefix != "" && !strings.HasPrefix(apiPrefix, "/") {
+		apiPrefix = "/" + apiPrefix
+	}
+
+	importMode := getEnv("IMPORT_MODE", "skip")
+	if importMode != "skip" && importMode != "upsert" {
+		logWarnf("Unknown IMPORT_MODE %q. Using skip.", importMode)
+		importMode = "skip"
+	}
+
+	rootBehavior := getEnv("ROOT_BEHAVIOR", "redirect")
+	if rootBehavior != "redirect" && rootBehavior != "index" {
+		logWarnf("Invalid ROOT_BEHAVIOR %q: expected redirect or index. Using redirect.", rootBehavior)
+		rootBehavior = "redirect"
+	}
+
+	s := &Server{
+		tableName:        getEnv("DB_TABLE", "records"),
+		queryTimeout:     getEnvDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+		cache:            newResponseCache(getEnvDuration("CACHE_TTL", 0)),
+		idempotency:      newIdempotencyStore(getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)),
+		apiPrefix:        apiPrefix,
+		rootBehavior:     rootBehavior,
+		importMode:       importMode,
+		enablePprof:      getEnvBool("ENABLE_PPROF", false),
+		maxResultRows:    getEnvInt("MAX_RESULT_ROWS", 10000),
+		responseEnvelope: getEnvBool("RESPONSE_ENVELOPE", false),
+		randomCount:      max(getEnvInt("RANDOM_DEFAULT_COUNT", 10), 1),
+		maxRandomCount:   max(getEnvInt("RANDOM_MAX_COUNT", 100), 1),
+		validateCIDs:     getEnvBool("VALIDATE_CID", false),
+		ipfsGateway:      ipfsGatewayFromEnv(),
+		uniqueNames:      getEnvBool("UNIQUE_NAME", false),
+		nameTrigramIndex: getEnvBool("NAME_TRIGRAM_INDEX", false),
+		cacheNotify:      getEnvBool("CACHE_NOTIFY", false),
+
+		slowQueryThreshold: time.Duration(getEnvInt("SLOW_QUERY_MS", 500)) * time.Millisecond,
+	}
+	s.readOnly.Store(getEnvBool("READ_ONLY", false))
+	if s.readOnly.Load() {
+		logEvent("read_only_enabled", "Starting in read-only mode; writes are refused.")
+	}
+	return s
+}
+
+// Build the request router wrapped in the middleware chain
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", s.rootHandler)
+	s.registerAPIRoutes(mux, s.apiPrefix)
+	if s.apiPrefix != apiV1Prefix {
+		s.registerAPIRoutes(mux, apiV1Prefix)
+	}
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/ready", s.readyHandler)
+	mux.HandleFunc("GET /version", versionHandler)
+	mux.HandleFunc("GET /openapi.json", s.openAPIHandler)
+	mux.HandleFunc("GET /schema", schemaHandler)
+	mux.HandleFunc("/metrics", requireAPIKey(promhttp.Handler().ServeHTTP))
+	mux.HandleFunc("GET /stats", requireAPIKey(s.statsHandler))
+	mux.HandleFunc("POST /admin/reload", requireAPIKey(s.reloadHandler))
+	mux.HandleFunc("PUT /admin/read-only", requireAPIKey(s.readOnlyHandler))
+	mux.HandleFunc("GET /admin/import/progress", requireAPIKey(s.importProgressHandler))
+	if s.enablePprof {
+		registerPprofRoutes(mux)
+		log.Println("Profiling endpoints enabled at /debug/pprof/.")
+	}
+
+	// Panics are recovered inside compress so the error response is still
+	// encoded and counted like any other
+	// requestID is outermost because it replaces the request, while the
+	// middleware inside it read the route pattern the mux sets on theirs
+	return requestID(logRequests(traceRequests(instrumentRequests(cors(rateLimit(compress(s.cache.invalidateCacheOnWrite(s.rejectWritesWhenReadOnly(s.requireDB(recoverPanics(jsonRoutingErrors(mux))))))))))))
+}
+
+// Register the data API routes under the given path prefix. Probe, operational,
+// and documentation endpoints are registered separately and always stay at
+// the root.
+func (s *Server) registerAPIRoutes(mux *http.ServeMux, prefix string) {
+	routes := []struct {
+		pattern string
+		handler http.HandlerFunc
+	}{
+		{"GET /data", s.cache.cacheResponses(s.fetchDataHandler)},
+		{"POST /data", s.idempotency.idempotent(s.createRecordHandler)},
+		{"POST /data/bulk", s.bulkCreateRecordsHandler},
+		{"POST /data/lookup", s.lookupRecordsHandler},
+		{"GET /data.csv", s.exportCSVHandler},
+		{"GET /count", s.countHandler},
+		{"GET /data/random", s.randomRecordsHandler},
+		{"GET /data/{$}", s.fetchRecordByCIDHandler},
+		{"GET /data/{cid}", s.fetchRecordByCIDHandler},
+		{"PUT /data/{cid}", s.updateRecordHandler},
+		{"PATCH /data/{cid}", s.patchRecordHandler},
+		{"DELETE /data/bulk", s.bulkDeleteRecordsHandler},
+		{"DELETE /data/{cid}", s.deleteRecordHandler},
+		{"POST /data/{cid}/restore", s.restoreRecordHandler},
+		{"POST /upload", s.uploadHandler},
+	}
+	for _, route := range routes {
+		mux.HandleFunc(prefixPattern(prefix, route.pattern), requireAPIKey(route.handler))
+	}
+}
+
+// Handle requests for /: a permanent redirect to the records listing, or with
+// ROOT_BEHAVIOR=index a short JSON index of the main endpoints
+func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	if s.rootBehavior != "index" {
+		http.Redirect(w, r, s.apiPrefix+"/data", http.StatusPermanentRedirect)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":    "Records API",
+		"version": version,
+		"endpoints": map[string]string{
+			"data":    s.apiPrefix + "/data",
+			"count":   s.apiPrefix + "/count",
+			"random":  s.apiPrefix + "/data/random",
+			"export":  s.apiPrefix + "/data.csv",
+			"openapi": "/openapi.json",
+			"schema":  "/schema",
+			"health":  "/health",
+			"ready":   "/ready",
+			"version": "/version",
+		},
+	})
+}
+
+// Register the runtime profiling handlers under /debug/pprof/. They are put on
+// the server's own mux rather than http.DefaultServeMux, where importing
+// net/http/pprof would otherwise expose them unconditionally.
+func registerPprofRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", requireAPIKey(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAPIKey(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAPIKey(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAPIKey(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAPIKey(pprof.Trace))
+}
+
+// Insert prefix in front of the path of a ServeMux pattern, keeping any method,
+// e.g. ("/api/v1", "GET /count") becomes "GET /api/v1/count"
+func prefixPattern(prefix, pattern string) string {
+	if method, path, found := strings.Cut(pattern, " "); found {
+		return method + " " + prefix + path
+	}
+	return prefix + pattern
+}
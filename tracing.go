@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Set once setupTracing has installed an exporter. While false, handlers and
+// the database are left uninstrumented.
+var tracingEnabled bool
+
+// Export traces over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is set. The
+// exporter also honors the other standard OTEL_* variables, and
+// OTEL_SERVICE_NAME overrides the default service name. The returned function
+// flushes pending spans and is a no-op when tracing is disabled.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("golang-usecase"), semconv.ServiceVersion(version)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingEnabled = true
+	logEvent("tracing_enabled", "OpenTelemetry tracing enabled.", "endpoint", getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""))
+	return provider.Shutdown, nil
+}
+
+// Open the PostgreSQL connection pool, with a span for every query when
+// tracing is enabled
+func openDB(connStr string) (*sql.DB, error) {
+	if !tracingEnabled {
+		return sql.Open("postgres", connStr)
+	}
+	return otelsql.Open("postgres", connStr,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitRows: true, OmitConnResetSession: true}))
+}
+
+// Start a server span for each request, continuing the trace from the
+// incoming traceparent header. Spans are renamed after the matched route once
+// the mux has run, so path parameters stay out of span names.
+func traceRequests(next http.Handler) http.Handler {
+	if !tracingEnabled {
+		return next
+	}
+
+	named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Pattern == "" {
+			return
+		}
+		_, route, found := strings.Cut(r.Pattern, " ")
+		if !found {
+			route = r.Pattern
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	})
+	return otelhttp.NewHandler(named, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }))
+}